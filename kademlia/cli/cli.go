@@ -20,6 +20,8 @@ func Run(args []string) error {
 		return cmdLocalGet(args[1:])
 	case "rt":
 		return cmdRT(args[1:])
+	case "trace":
+		return cmdTrace(args[1:])
 	case "help", "-h", "--help":
 		usage()
 		return nil
@@ -38,13 +40,17 @@ func usage() {
 	fmt.Println(`kademlia
 
 Usage:
-  serve   [-bind :9999] [-seeds host:port,host:port]
-  put  [-to 127.0.0.1:9999] -value "..."
-  get  keyhex [-to 127.0.0.1:9999]
+  serve   [-bind :9999] [-seeds host:port,host:port] [-data dir] [-store mem|dir|log] [-max-bytes n] [-max-keys n]
+  put  [-to 127.0.0.1:9999] [-ttl 10m] (-value "..." | -file path | -)
+  get  keyhex [-to 127.0.0.1:9999] [-o file]
+  trace [-to 127.0.0.1:9999] [-json] keyhex
 
 
 Examples:
   docker exec d7024e-lab-assignment-node-# /app/node serve -bind :9999 -seeds node1:9999,node2:9999
   docker exec d7024e-lab-assignment-node-# /app/node put -to node2:9999 -value "hello world"
-  docker exec d7024e-lab-assignment-node-# /app/node get  5e884898da28047151d0e56f8dc6292773603d0d@node2:9999`)
+  docker exec d7024e-lab-assignment-node-# /app/node get  5e884898da28047151d0e56f8dc6292773603d0d@node2:9999
+  docker exec -i d7024e-lab-assignment-node-# /app/node put - < config.yaml
+  docker exec d7024e-lab-assignment-node-# /app/node get  5e884898da28047151d0e56f8dc6292773603d0d -o config.yaml
+  docker exec d7024e-lab-assignment-node-# /app/node trace -json 5e884898da28047151d0e56f8dc6292773603d0d`)
 }
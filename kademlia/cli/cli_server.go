@@ -1,12 +1,15 @@
 package cli
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"strings"
@@ -14,15 +17,32 @@ import (
 	"time"
 
 	"github.com/Limpowitch/D7024E-Lab-Assignment/kademlia/cmd/node"
+	"github.com/Limpowitch/D7024E-Lab-Assignment/kademlia/service"
 )
 
 func cmdServe(args []string) error {
 	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
 	ttlStr := fs.String("ttl", "24h", "TTL for stored values (e.g. 30s, 10m, 24h)")
 	refreshStr := fs.String("refresh", "", "Refresh interval for origin (default: ttl/2)")
+	maxTTLStr := fs.String("max-ttl", "", "longest TTL a publisher may ask for (default: ttl)")
+	republishStr := fs.String("republish", "1h", "store replicas not received for this long again at the k closest (0 disables)")
 	bind := fs.String("bind", "0.0.0.0:9999", "UDP bind address")
 	seeds := fs.String("seeds", "", "comma-separated bootstrap peers host:port")
 	adv := fs.String("adv", "", "advertised addr host:port")
+	bucketRefreshStr := fs.String("bucket-refresh", "1h", "refresh buckets with no traffic for this long (0 disables)")
+	maxFailures := fs.Int("max-failures", node.DefaultMaxFailures, "evict a contact after this many failed RPCs in a row")
+	stateFile := fs.String("state", "", "file to save the routing table to and reload it from on start")
+	stateEveryStr := fs.String("state-every", "1m", "how often the routing table is saved to -state")
+	idFile := fs.String("id-file", "", "file holding the node id, created on first start")
+	idHex := fs.String("id", "", "node id as 40 hex chars (overrides -id-file)")
+	cacheLookups := fs.Bool("cache-lookups", true, "cache found values at the closest node on the lookup path")
+	disjoint := fs.Int("disjoint", 1, "number of disjoint lookup paths (1 = single path)")
+	storeKind := fs.String("store", "", "where values are kept: mem, dir or log (default log with -data, mem without)")
+	dataDir := fs.String("data", "", "directory for -store dir and log")
+	maxBytes := fs.Int64("max-bytes", 0, "most bytes of values to hold, 0 = no limit")
+	maxKeys := fs.Int("max-keys", 0, "most values to hold, 0 = no limit")
+	rtoMinStr := fs.String("rto-min", service.DefaultMinRTO.String(), "lower bound of the per-peer rpc timeout")
+	rtoMaxStr := fs.String("rto-max", service.DefaultMaxRTO.String(), "upper bound of the per-peer rpc timeout")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
@@ -40,24 +60,97 @@ func cmdServe(args []string) error {
 		}
 	}
 
-	n, err := node.NewNode(*bind, *adv, ttl, refresh)
+	maxTTL := ttl
+	if *maxTTLStr != "" {
+		if maxTTL, err = time.ParseDuration(*maxTTLStr); err != nil {
+			return fmt.Errorf("bad -max-ttl: %w", err)
+		}
+	}
+
+	republish, err := time.ParseDuration(*republishStr)
+	if err != nil {
+		return fmt.Errorf("bad -republish: %w", err)
+	}
+
+	bucketRefresh, err := time.ParseDuration(*bucketRefreshStr)
+	if err != nil {
+		return fmt.Errorf("bad -bucket-refresh: %w", err)
+	}
+
+	stateEvery, err := time.ParseDuration(*stateEveryStr)
+	if err != nil {
+		return fmt.Errorf("bad -state-every: %w", err)
+	}
+
+	rtoMin, err := time.ParseDuration(*rtoMinStr)
+	if err != nil {
+		return fmt.Errorf("bad -rto-min: %w", err)
+	}
+	rtoMax, err := time.ParseDuration(*rtoMaxStr)
+	if err != nil {
+		return fmt.Errorf("bad -rto-max: %w", err)
+	}
+	if rtoMax < rtoMin {
+		return errors.New("-rto-max must not be below -rto-min")
+	}
+
+	var id [20]byte
+	switch {
+	case *idHex != "":
+		if id, err = node.ParseID(*idHex); err != nil {
+			return fmt.Errorf("bad -id: %w", err)
+		}
+	case *idFile != "":
+		if id, err = node.LoadOrCreateID(*idFile); err != nil {
+			return err
+		}
+	default:
+		if _, err := rand.Read(id[:]); err != nil {
+			return err
+		}
+	}
+
+	n, err := node.NewNodeWithID(*bind, *adv, id, ttl, refresh)
+	if err != nil {
+		return err
+	}
+	n.BucketRefresh = bucketRefresh
+	n.StateFile = *stateFile
+	n.StateEvery = stateEvery
+	n.CacheOnLookup = *cacheLookups
+	n.DisjointPaths = *disjoint
+	n.MaxTTL = maxTTL
+	n.Republish = republish
+	n.RoutingTable.MaxFailures = *maxFailures
+	store, err := openStore(*storeKind, *dataDir)
 	if err != nil {
+		n.Close()
 		return err
 	}
+	n.Store = store
+	if *maxBytes > 0 || *maxKeys > 0 {
+		q, err := node.NewQuotaStore(store, n.NodeID, *maxBytes, *maxKeys)
+		if err != nil {
+			n.Close()
+			return err
+		}
+		n.Store = q
+	}
+	n.Svc.MinRTO = rtoMin
+	n.Svc.MaxRTO = rtoMax
 	n.Start()
-	fmt.Println("node listening on", n.Svc.Addr())
+	fmt.Printf("node %x listening on %s\n", n.NodeID[:], n.Svc.Addr())
 
 	// bootstrap: ping each seed and do one FindNode to kick-start RT
 	// after n.Start() in cmdServe
 	for _, s := range splitCSV(*seeds) {
 		// 1) learn seed’s ID
-		ctx, c := context.WithTimeout(context.Background(), time.Second)
+		ctx, c := context.WithTimeout(context.Background(), n.Svc.RTO(s))
 		_ = n.Svc.Ping(ctx, s)
 		c()
 
 		// 2) several lookups to diversify buckets
 		for i := 0; i < 4; i++ {
-			ctx2, c2 := context.WithTimeout(context.Background(), 1200*time.Millisecond)
 			// random target near self on first pass; fully random afterwards
 			var t [20]byte
 			if i == 0 {
@@ -66,6 +159,7 @@ func cmdServe(args []string) error {
 				if _, err := rand.Read(t[:]); err == nil { /* ok */
 				}
 			}
+			ctx2, c2 := context.WithTimeout(context.Background(), n.LookupTimeout(t))
 			_, err = n.LookupNode(ctx2, t)
 			if err != nil {
 				fmt.Println("error: ", err)
@@ -78,6 +172,29 @@ func cmdServe(args []string) error {
 	return n.Close()
 }
 
+// opens the value store picked with -store
+func openStore(kind, dir string) (node.Storage, error) {
+	if kind == "" {
+		kind = "mem"
+		if dir != "" {
+			kind = "log"
+		}
+	}
+	if kind != "mem" && dir == "" {
+		return nil, fmt.Errorf("-store %s needs -data", kind)
+	}
+	switch kind {
+	case "mem":
+		return node.NewMemoryStore(), nil
+	case "dir":
+		return node.OpenDirStore(dir)
+	case "log":
+		return node.OpenLogStore(dir)
+	default:
+		return nil, fmt.Errorf("bad -store %q (mem, dir or log)", kind)
+	}
+}
+
 func cmdForget(args []string) error {
 	fs := flag.NewFlagSet("forget", flag.ContinueOnError)
 	to := fs.String("to", "127.0.0.1:9999", "address of local daemon")
@@ -138,16 +255,51 @@ func cmdExit(args []string) error {
 }
 
 // local-put: talk to 127.0.0.1:9999 (or override) and ask daemon to store.
+// the value comes from -value, -file or stdin ("put -")
 func cmdLocalPut(args []string) error {
 	fs := flag.NewFlagSet("local-put", flag.ContinueOnError)
 	value := fs.String("value", "", "UTF-8 string to store")
+	file := fs.String("file", "", "store the contents of this file")
+	ttlStr := fs.String("ttl", "", "how long the value should live, capped by the nodes (default: theirs)")
 	to := fs.String("to", "127.0.0.1:9999", "local daemon addr")
 	bind := fs.String("bind", ":0", "ephemeral client bind")
-	if err := fs.Parse(args); err != nil {
+	if err := parseInterspersed(fs, args); err != nil {
 		return err
 	}
-	if *value == "" {
-		return errors.New("-value is required")
+
+	// an empty value is fine, it just has to be asked for
+	valueSet := false
+	fs.Visit(func(f *flag.Flag) { valueSet = valueSet || f.Name == "value" })
+	stdin := fs.NArg() == 1 && fs.Arg(0) == "-"
+	sources := 0
+	for _, b := range []bool{valueSet, *file != "", stdin} {
+		if b {
+			sources++
+		}
+	}
+	if sources != 1 || fs.NArg() > 1 || (fs.NArg() == 1 && !stdin) {
+		return errors.New("usage: put [-to addr] [-ttl 10m] (-value \"...\" | -file path | -)")
+	}
+
+	var ttl time.Duration
+	var err error
+	if *ttlStr != "" {
+		if ttl, err = time.ParseDuration(*ttlStr); err != nil || ttl <= 0 {
+			return fmt.Errorf("bad -ttl %q", *ttlStr)
+		}
+	}
+
+	var data []byte
+	switch {
+	case valueSet:
+		data = []byte(*value)
+	case *file != "":
+		data, err = readFileLimited(*file)
+	default:
+		data, err = readLimited("stdin", os.Stdin)
+	}
+	if err != nil {
+		return err
 	}
 
 	// small client node just to send the admin RPC:
@@ -158,9 +310,12 @@ func cmdLocalPut(args []string) error {
 	n.Start()
 	defer n.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	key, err := n.Svc.AdminPut(ctx, *to, []byte(*value))
+	// big values go in as chunks plus a manifest, every piece is its own ADMIN_PUT
+	key, err := node.PutObject(context.Background(), data, func(ctx context.Context, v []byte) ([20]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		return n.Svc.AdminPut(ctx, *to, v, ttl)
+	})
 	if err != nil {
 		return err
 	}
@@ -168,15 +323,45 @@ func cmdLocalPut(args []string) error {
 	return nil
 }
 
-// local-get: ask local daemon to resolve using its RT
+// reads all of r, but stops as soon as it is clear the value will not fit in node.MaxObjectSize
+func readLimited(name string, r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, node.MaxObjectSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	if len(data) > node.MaxObjectSize {
+		return nil, errTooLarge(name)
+	}
+	return data, nil
+}
+
+// like readLimited, but a regular file that is too large is rejected on its size before reading any of it
+func readFileLimited(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() && fi.Size() > node.MaxObjectSize {
+		return nil, errTooLarge(path)
+	}
+	return readLimited(path, f) // still limited, the file may grow or not be a regular file
+}
+
+func errTooLarge(name string) error {
+	return fmt.Errorf("%s is too large: values can be at most %d bytes", name, node.MaxObjectSize)
+}
+
+// local-get: ask local daemon to resolve using its RT, the value is written as is to stdout (or -o)
 func cmdLocalGet(args []string) error {
 	fs := flag.NewFlagSet("local-get", flag.ContinueOnError)
 	to := fs.String("to", "127.0.0.1:9999", "address of local daemon")
-	if err := fs.Parse(args); err != nil {
+	out := fs.String("o", "", "write the value to this file instead of stdout")
+	if err := parseInterspersed(fs, args); err != nil {
 		return err
 	}
 	if fs.NArg() != 1 {
-		return errors.New("usage: get <keyhex>")
+		return errors.New("usage: get [-to addr] [-o file] <keyhex>")
 	}
 
 	keyb, err := hex.DecodeString(fs.Arg(0))
@@ -195,20 +380,72 @@ func cmdLocalGet(args []string) error {
 	n.Start()
 	defer n.Close()
 
-	// can probably be 5 seconds at this point (maybe less) but tried with 15 when we had race conditions
+	// the key may be a manifest, GetObject then fetches (and checks) its chunks with more ADMIN_GETs
+	val, err := node.GetObject(context.Background(), key, func(ctx context.Context, k [20]byte) ([]byte, error) {
+		// can probably be 5 seconds at this point (maybe less) but tried with 15 when we had race conditions
+		ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+		v, ok, err := n.Svc.AdminGet(ctx, *to, k)
+		if err == nil && !ok {
+			err = errors.New("not found")
+		}
+		return v, err
+	})
+	if err != nil {
+		return err
+	}
+	if *out != "" {
+		return os.WriteFile(*out, val, 0o644)
+	}
+	_, err = os.Stdout.Write(val)
+	return err
+}
+
+// trace: ask local daemon to run the lookup for a key and print every hop it made
+func cmdTrace(args []string) error {
+	fs := flag.NewFlagSet("trace", flag.ContinueOnError)
+	to := fs.String("to", "127.0.0.1:9999", "address of local daemon")
+	asJSON := fs.Bool("json", false, "print the raw trace as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: trace [-to addr] [-json] <keyhex>")
+	}
+
+	key, err := node.ParseID(fs.Arg(0))
+	if err != nil {
+		return errors.New("bad key (need 40 hex chars)")
+	}
+
+	n, err := node.NewNode(":0", "", 24*time.Hour, 0)
+	if err != nil {
+		return err
+	}
+	n.Start()
+	defer n.Close()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 
-	val, ok, err := n.Svc.AdminGet(ctx, *to, key)
+	raw, err := n.Svc.AdminTrace(ctx, *to, key)
 	if err != nil {
 		return err
 	}
-	if !ok {
-		return errors.New("not found")
+	if *asJSON {
+		var out bytes.Buffer
+		if err := json.Indent(&out, raw, "", "  "); err != nil {
+			return err
+		}
+		fmt.Println(out.String())
+		return nil
+	}
+
+	var tr node.LookupTrace
+	if err := json.Unmarshal(raw, &tr); err != nil {
+		return fmt.Errorf("bad trace: %w", err)
 	}
-	fmt.Println(string(val))
-	fmt.Printf("%q\n", val)
-	fmt.Printf("[len=%d]\n", len(val))
+	tr.PrintTree(os.Stdout)
 	return nil
 }
 
@@ -248,6 +485,23 @@ func cmdRT(args []string) error {
 	return nil
 }
 
+// parses args like fs.Parse, but flags may also come after the positional arguments
+// (get <key> -o file). a lone "-" is kept as a positional argument
+func parseInterspersed(fs *flag.FlagSet, args []string) error {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	return fs.Parse(pos)
+}
+
 // Splits comma separated values and trims spaces
 func splitCSV(s string) []string {
 	var out []string
@@ -8,6 +8,7 @@ type Contact struct {
 	ID       NodeID
 	Addr     string    // "host:port"
 	LastSeen time.Time // updated on successful RPC if we want to do as we talked about in sprint 0 review//samme
+	Failures int       // RPCs in a row that failed, reset on success
 }
 
 // Creates a new contact with given information.
@@ -1,9 +1,15 @@
 package node
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/Limpowitch/D7024E-Lab-Assignment/kademlia/service"
 )
 
 // func TestGetValueIterative_BasicScenarios(t *testing.T) {
@@ -23,7 +29,7 @@ import (
 // 	nC.RoutingTable.Update(Contact{ID: nA.NodeID, Addr: nA.Svc.Addr()})
 
 // 	// Store value on B
-// 	key := SHA1ID([]byte("iter-test"))
+// 	key := SHA1ID([]byte("xyz"))
 // 	nB.mu.Lock()
 // 	nB.Store[string(key[:])] = Value{Data: []byte("xyz"), ExpiresAt: time.Now().Add(nB.ttl)}
 // 	nB.mu.Unlock()
@@ -35,7 +41,7 @@ import (
 // 	if err != nil {
 // 		t.Fatal(err)
 // 	}
-// 	if val != "xyz" {
+// 	if string(val) != "xyz" {
 // 		t.Fatalf("expected xyz, got %q", val)
 // 	}
 
@@ -44,7 +50,7 @@ import (
 // 	ctx2, cancel2 := context.WithTimeout(context.Background(), 3*time.Second)
 // 	defer cancel2()
 // 	val, _, err = nA.GetValueIterative(ctx2, badKey, nA.RoutingTable.Closest(badKey, K))
-// 	if err == nil && val != "" {
+// 	if err == nil || val != nil {
 // 		t.Fatalf("expected miss, got %q", val)
 // 	}
 // }
@@ -84,10 +90,10 @@ func TestKbucketSplit_BasicScenarios(t *testing.T) {
 	t.Logf("[D] buckets=%d\n%s", nD.RoutingTable.BucketsLen(), nD.RoutingTable.Dump())
 
 	// Store value on B
-	key := SHA1ID([]byte("iter-test"))
+	key := SHA1ID([]byte("xyz"))
 	for _, c := range nA.RoutingTable.Closest(key, K) {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		_ = nA.Svc.Store(ctx, c.Addr, key, []byte("xyz"))
+		_ = nA.Svc.Store(ctx, c.Addr, key, []byte("xyz"), 0)
 		cancel()
 	}
 
@@ -103,7 +109,7 @@ func TestKbucketSplit_BasicScenarios(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if val != "xyz" {
+	if string(val) != "xyz" {
 		t.Fatalf("expected xyz, got %q", val)
 	}
 
@@ -112,7 +118,271 @@ func TestKbucketSplit_BasicScenarios(t *testing.T) {
 	ctx2, cancel2 := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel2()
 	val, _, err = nA.GetValueIterative(ctx2, badKey, nA.RoutingTable.Closest(badKey, K))
-	if err == nil && val != "" {
+	if err == nil || val != nil {
 		t.Fatalf("expected miss, got %q", val)
 	}
 }
+
+// A knows B, B knows C and C holds the value. A's lookup goes through B, which does not have it
+func lookupPathNetwork(t *testing.T) (a, b, c *Node, key [20]byte) {
+	t.Helper()
+	nodes := startNodes(t, 3)
+	a, b, c = nodes[0], nodes[1], nodes[2]
+	a.RoutingTable.Update(Contact{ID: b.NodeID, Addr: b.Svc.Addr()})
+	b.RoutingTable.Update(Contact{ID: c.NodeID, Addr: c.Svc.Addr()})
+
+	key = SHA1ID([]byte("cached?"))
+	_ = c.Store.Put(key, Value{Data: []byte("cached?"), ExpiresAt: time.Now().Add(time.Minute)})
+	return a, b, c, key
+}
+
+func TestGetValueIterative_CachesAtClosestNodeWithoutValue(t *testing.T) {
+	a, b, _, key := lookupPathNetwork(t)
+	a.CacheTTL = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	val, contacts, err := a.GetValueIterative(ctx, key, nil)
+	if err != nil || string(val) != "cached?" {
+		t.Fatalf("lookup failed: %q %v", val, err)
+	}
+	if len(contacts) == 0 {
+		t.Fatal("a successful lookup should still return its shortlist")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		v, ok := b.Store.Get(key)
+		if ok {
+			if !v.Cached || string(v.Data) != "cached?" {
+				t.Fatalf("expected a cached copy on B, got %+v", v)
+			}
+			if left := time.Until(v.ExpiresAt); left > time.Minute {
+				t.Fatalf("cached copy should have a short ttl, expires in %v", left)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("B never got a cached copy")
+}
+
+func TestGetValueIterative_CachingCanBeDisabled(t *testing.T) {
+	a, b, _, key := lookupPathNetwork(t)
+	a.CacheOnLookup = false
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if val, _, err := a.GetValueIterative(ctx, key, nil); err != nil || string(val) != "cached?" {
+		t.Fatalf("lookup failed: %q %v", val, err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	_, ok := b.Store.Get(key)
+	if ok {
+		t.Fatal("B should not get a cached copy when caching is off")
+	}
+}
+
+func TestCacheTTL_FallsOffWithDistance(t *testing.T) {
+	n := &Node{CacheTTL: time.Minute}
+	if n.cacheTTL(0) != time.Minute || n.cacheTTL(1) != 30*time.Second || n.cacheTTL(2) != 15*time.Second {
+		t.Fatalf("expected ttl to halve per node in between, got %v %v %v", n.cacheTTL(0), n.cacheTTL(1), n.cacheTTL(2))
+	}
+	if n.cacheTTL(100) != time.Second {
+		t.Fatalf("expected 1s floor, got %v", n.cacheTTL(100))
+	}
+}
+
+func TestGetValueIterative_BinaryAndEmptyValues(t *testing.T) {
+	nodes := startNodes(t, 2)
+	a, b := nodes[0], nodes[1]
+	a.RoutingTable.Update(Contact{ID: b.NodeID, Addr: b.Svc.Addr()})
+	a.CacheOnLookup = false
+
+	for _, data := range [][]byte{{0x00, 0xff, '\n', 0x00}, {}} {
+		key := SHA1ID(data)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := a.Svc.Store(ctx, b.Svc.Addr(), key, data, 0); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+		val, _, err := a.GetValueIterative(ctx, key, nil)
+		cancel()
+		if err != nil || val == nil || !bytes.Equal(val, data) {
+			t.Fatalf("expected %x back, got %x (nil=%v) err=%v", data, val, val == nil, err)
+		}
+	}
+}
+
+func TestStore_RejectsValueThatDoesNotMatchKey(t *testing.T) {
+	nodes := startNodes(t, 2)
+	a, b := nodes[0], nodes[1]
+
+	key := SHA1ID([]byte("real"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.Svc.Store(ctx, b.Svc.Addr(), key, []byte("fake"), 0); err == nil {
+		t.Fatal("expected the store to be rejected")
+	}
+	_, ok := b.Store.Get(key)
+	if ok {
+		t.Fatal("rejected value was stored anyway")
+	}
+}
+
+func TestStore_PublisherTTLIsCappedByReceiver(t *testing.T) {
+	nodes := startNodesWith(t, 2, func(n *Node) { n.MaxTTL = time.Hour })
+	a, b := nodes[0], nodes[1]
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, tc := range []struct {
+		val       string
+		ask, want time.Duration
+	}{
+		{"short", time.Minute, time.Minute},
+		{"long", 48 * time.Hour, time.Hour},
+		{"default", 0, 10 * time.Second}, // startNodes uses a 10s ttl
+	} {
+		key := SHA1ID([]byte(tc.val))
+		if err := a.Svc.Store(ctx, b.Svc.Addr(), key, []byte(tc.val), tc.ask); err != nil {
+			t.Fatal(err)
+		}
+		v, ok := b.Store.Get(key)
+		if !ok || v.TTL != tc.want {
+			t.Fatalf("%s: stored with ttl %v, want %v", tc.val, v.TTL, tc.want)
+		}
+		if left := time.Until(v.ExpiresAt); left > tc.want || left < tc.want-time.Second {
+			t.Fatalf("%s: expires in %v, want %v", tc.val, left, tc.want)
+		}
+	}
+}
+
+func TestReplicaTTL_HalvedPastTheKClosest(t *testing.T) {
+	n, err := NewNode("127.0.0.1:0", "", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	key := n.NodeID
+	key[0] ^= 0x80 // as far from us as it gets
+	closer := func(i int) Contact {
+		id := key
+		id[19] ^= byte(i)
+		return Contact{ID: id, Addr: fmt.Sprintf("127.0.0.1:%d", 10000+i)}
+	}
+	for i := 1; i < K; i++ {
+		n.RoutingTable.Update(closer(i))
+	}
+	if got := n.replicaTTL(key, 0); got != time.Hour {
+		t.Fatalf("still among the K closest, want the full ttl, got %v", got)
+	}
+	n.RoutingTable.Update(closer(K))
+	if got := n.replicaTTL(key, 0); got != 30*time.Minute {
+		t.Fatalf("one past the K closest, want half the ttl, got %v", got)
+	}
+	if got := n.replicaTTL(n.NodeID, 0); got != time.Hour {
+		t.Fatalf("key right on us should get the full ttl, got %v", got)
+	}
+}
+
+// the replica ttl is for copies held for others, our own values keep the expiry their publisher gave them
+func TestOriginValue_KeepsExpiryOnFindValueAndRefresh(t *testing.T) {
+	nodes := startNodes(t, 2)
+	a, b := nodes[0], nodes[1]
+	key := SHA1ID([]byte("mine"))
+	expires := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	_ = b.Store.Put(key, Value{Data: []byte("mine"), Origin: true, TTL: time.Hour, ExpiresAt: expires})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := a.Svc.FindValue(ctx, b.Svc.Addr(), key); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := a.Svc.Refresh(ctx, b.Svc.Addr(), key); err != nil || !held {
+		t.Fatalf("refresh of an origin value: held=%v err=%v", held, err)
+	}
+	if v, _ := b.Store.Get(key); !v.ExpiresAt.Equal(expires) {
+		t.Fatalf("origin value expiry moved from %v to %v", expires, v.ExpiresAt)
+	}
+}
+
+func TestStore_RejectedWhenFull(t *testing.T) {
+	a := startNodes(t, 1)[0]
+	b, err := NewNode("127.0.0.1:0", "", 10*time.Second, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Store, err = NewQuotaStore(b.Store, b.NodeID, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	b.Svc.Start()
+	t.Cleanup(func() { _ = b.Close() })
+	_ = b.Store.Put(SHA1ID([]byte("mine")), Value{Data: []byte("mine"), Origin: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = a.Svc.Store(ctx, b.Svc.Addr(), SHA1ID([]byte("yours")), []byte("yours"), 0)
+	if err == nil || !strings.Contains(err.Error(), ErrStoreFull.Error()) {
+		t.Fatalf("expected a store full rejection, got %v", err)
+	}
+}
+
+// a put our own store has no room for fails before it is STOREd anywhere else
+func TestAdminPut_StoreFullFailsBeforeReplicating(t *testing.T) {
+	a := startNodes(t, 1)[0]
+	b, err := NewNode("127.0.0.1:0", "", 10*time.Second, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Store, err = NewQuotaStore(b.Store, b.NodeID, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	b.Svc.Start()
+	t.Cleanup(func() { _ = b.Close() })
+	_ = b.Store.Put(SHA1ID([]byte("mine")), Value{Data: []byte("mine"), Origin: true})
+	b.RoutingTable.Update(Contact{ID: a.NodeID, Addr: a.Svc.Addr()})
+
+	if _, err := b.Svc.OnAdminPut([]byte("yours"), 0); !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("expected ErrStoreFull, got %v", err)
+	}
+	if _, ok := a.Store.Get(SHA1ID([]byte("yours"))); ok {
+		t.Fatal("a rejected put should not have been replicated")
+	}
+}
+
+func TestGetValueIterative_SkipsPoisonedValue(t *testing.T) {
+	a := startNodes(t, 1)[0]
+	a.CacheOnLookup = false
+	key := SHA1ID([]byte("genuine"))
+
+	peer := func(val string, delay time.Duration) Contact {
+		svc, err := service.New("127.0.0.1:0", RandomNodeID(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		svc.OnFindValue = func(key [20]byte) ([]byte, []byte) {
+			time.Sleep(delay)
+			return []byte(val), nil
+		}
+		svc.Start()
+		t.Cleanup(func() { _ = svc.Close() })
+		return Contact{ID: svc.SelfID, Addr: svc.Addr()}
+	}
+	// the poisoner answers first, with a value that does not match the key
+	poisoner := peer("poison", 0)
+	holder := peer("genuine", 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	val, contacts, err := a.GetValueIterative(ctx, key, []Contact{poisoner, holder})
+	if err != nil || string(val) != "genuine" {
+		t.Fatalf("expected the genuine value, got %q %v", val, err)
+	}
+	for _, c := range contacts {
+		if c.ID == poisoner.ID {
+			t.Fatal("the poisoning node should be dropped from the lookup")
+		}
+	}
+}
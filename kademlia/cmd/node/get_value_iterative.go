@@ -3,113 +3,110 @@ package node
 import (
 	"context"
 	"log"
-	"sync"
 	"time"
 )
 
-// Iterative lookup for a value by its key
-func (n *Node) GetValueIterative(ctx context.Context, key [20]byte, seeds []Contact) (string, []Contact, error) {
-	foundCh := make(chan string, 1)
-
-	sl := newShortlist(key, K)
+// Iterative lookup for a value by its key. a found value is never nil, even when it is empty
+func (n *Node) GetValueIterative(ctx context.Context, key [20]byte, seeds []Contact) ([]byte, []Contact, error) {
 	if len(seeds) == 0 {
 		seeds = n.RoutingTable.Closest(key, K)
 	}
-	if len(seeds) > 0 {
-		sl.add(seeds)
+	res, err := n.getValue(ctx, key, usableContacts(n.NodeID, seeds), nil)
+	if res.found {
+		return res.value, res.contacts, nil
 	}
+	return nil, res.contacts, err
+}
 
-	for {
-		batch := sl.nextBatch(alpha)
-		if len(batch) == 0 {
-			break
+// runs the value lookup from seeds, recording it in tr if set. err is non-nil whenever the value was
+// not found
+func (n *Node) getValue(ctx context.Context, key [20]byte, seeds []Contact, tr *LookupTrace) (lookupResult, error) {
+	res, err := n.runDisjointLookup(ctx, key, seeds, n.rpcTimeout, func(ctx context.Context, c Contact) (queryResult, error) {
+		log.Printf("[iter] QUERY  -> %s key=%x", c.Addr, key[:4])
+		res, err := n.Svc.FindValue(ctx, c.Addr, key)
+		if err != nil {
+			log.Printf("[iter] ERROR <- %s key=%x err=%v", c.Addr, key[:4], err)
+			return queryResult{}, err
 		}
 
-		// filter bad/self addrs
-		tmp := batch[:0]
-		for _, c := range batch {
-			if c.ID == n.NodeID || c.Addr == "" || c.Addr[0] == ':' {
-				continue
+		n.RoutingTable.Touch(Contact{ID: c.ID, Addr: c.Addr})
+
+		if res.Found {
+			if SHA1ID(res.Value) != key {
+				// a bad (or broken) node, drop it and keep looking
+				log.Printf("[iter] BAD VALUE <- %s key=%x len=%d", c.Addr, key[:4], len(res.Value))
+				return queryResult{}, ErrKeyMismatch
 			}
-			tmp = append(tmp, c)
-		}
-		batch = tmp
-		if len(batch) == 0 {
-			break
+			log.Printf("[iter] VALUE <- %s key=%x len=%d", c.Addr, key[:4], len(res.Value))
+			return queryResult{value: res.Value, found: true}, nil
 		}
 
-		var (
-			wg     sync.WaitGroup
-			mu     sync.Mutex // protects shortlist.add
-			doneCh = make(chan struct{})
-		)
-
-		wg.Add(len(batch))
-		for _, c := range batch {
-			c := c
-			go func() {
-				defer wg.Done()
-
-				// Per-RPC timeout bounded by caller’s ctx
-				rctx, rcancel := context.WithTimeout(ctx, 4*time.Second)
-				defer rcancel()
-
-				log.Printf("[iter] QUERY  -> %s key=%x", c.Addr, key[:4])
-				res, err := n.Svc.FindValue(rctx, c.Addr, key)
-				if err != nil {
-					log.Printf("[iter] ERROR <- %s key=%x err=%v", c.Addr, key[:4], err)
-					return
-				}
-
-				n.RoutingTable.Update(Contact{ID: c.ID, Addr: c.Addr})
-
-				if res.Value != nil {
-					log.Printf("[iter] VALUE <- %s key=%x len=%d", c.Addr, key[:4], len(res.Value))
-					select {
-					case foundCh <- string(res.Value):
-					default:
-					}
-					return
-				}
-
-				if len(res.Contacts) > 0 {
-					contacts, err := UnmarshalContactList(res.Contacts)
-					if err != nil {
-						return
-					}
-					mu.Lock()
-					_ = sl.add(contacts) // we don't need the bool anymore
-					mu.Unlock()
-					for _, sc := range contacts {
-						if sc.ID == n.NodeID || sc.Addr == "" || sc.Addr[0] == ':' {
-							continue
-						}
-						n.RoutingTable.Update(sc)
-					}
-				}
-			}()
+		var contacts []Contact
+		if len(res.Contacts) > 0 {
+			contacts, err = UnmarshalContactList(res.Contacts)
+			if err != nil {
+				return queryResult{}, err
+			}
+			contacts = usableContacts(n.NodeID, contacts)
+			for _, sc := range contacts {
+				n.RoutingTable.Update(sc)
+			}
+		}
+		return queryResult{contacts: contacts}, nil
+	}, tr)
+
+	if res.found {
+		log.Printf("[iter] DELIVER len=%d", len(res.value))
+		if n.CacheOnLookup {
+			// paper: store the value at the closest node we asked that did not have it
+			if res.hasCache {
+				go n.cacheAt(res.cacheAt, key, res.value, n.cacheTTL(res.between))
+			}
 		}
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	return res, context.DeadlineExceeded
+}
 
-		go func() { wg.Wait(); close(doneCh) }()
+// ttl of a cached copy, halved for every contact we know that sits between the cache node and the key
+func (n *Node) cacheTTL(between int) time.Duration {
+	return halveTTL(n.CacheTTL, between)
+}
 
-		select {
-		case v := <-foundCh:
-			log.Printf("[iter] DELIVER len=%d", len(v))
-			return v, nil, nil
+// ttl halved times, but at least a second
+func halveTTL(ttl time.Duration, times int) time.Duration {
+	if times > 30 {
+		times = 30
+	}
+	ttl >>= uint(times)
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl
+}
 
-		case <-doneCh:
-			// fire next batch (if any); nextBatch(alpha) will be empty if no progress
-			continue
+// sends a CACHE rpc with the value to c
+func (n *Node) cacheAt(c Contact, key [20]byte, value []byte, ttl time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.rpcTimeout(c))
+	defer cancel()
+	if err := n.Svc.Cache(ctx, c.Addr, key, value, ttl); err != nil {
+		log.Printf("[iter] CACHE -> %s key=%x failed: %v", c.Addr, key[:4], err)
+		return
+	}
+	log.Printf("[iter] CACHE -> %s key=%x ttl=%v", c.Addr, key[:4], ttl)
+}
 
-		case <-ctx.Done():
-			select {
-			case v := <-foundCh:
-				return v, nil, nil
-			default:
-			}
-			return "", sl.contacts(), ctx.Err()
+// filters out ourselves and contacts with bad/empty addresses
+func usableContacts(self [20]byte, cs []Contact) []Contact {
+	out := make([]Contact, 0, len(cs))
+	for _, c := range cs {
+		if c.ID == self || c.Addr == "" || c.Addr[0] == ':' {
+			continue
 		}
+		out = append(out, c)
 	}
-
-	return "", sl.contacts(), context.DeadlineExceeded
+	return out
 }
@@ -12,6 +12,19 @@ type NodeID [IDBytes]byte
 // random 160-bit ID for testing purposes
 func RandomNodeID() (id NodeID) { _, _ = rand.Read(id[:]); return }
 
+// random ID inside [lower, upper], used when refreshing a bucket
+func RandomIDInRange(lower, upper [IDBytes]byte) (id NodeID) {
+	lo := new(big.Int).SetBytes(lower[:])
+	span := new(big.Int).Sub(new(big.Int).SetBytes(upper[:]), lo)
+	span.Add(span, big.NewInt(1))
+	r, err := rand.Int(rand.Reader, span)
+	if err != nil {
+		return NodeID(lower)
+	}
+	r.Add(r, lo).FillBytes(id[:])
+	return id
+}
+
 // returns XOR distance for comparisons
 func Distance(a, b NodeID) *big.Int {
 	var x [IDBytes]byte
@@ -89,3 +89,19 @@ func TestRandomNodeID_NotZero_And_NotAllEqual(t *testing.T) {
 		t.Fatal("RandomNodeID returned identical ids repeatedly (extremely unlikely)")
 	}
 }
+
+func TestRandomIDInRange(t *testing.T) {
+	lower := idFromHex(t, "8000000000000000000000000000000000000000")
+	upper := idFromHex(t, "80ffffffffffffffffffffffffffffffffffffff")
+	for i := 0; i < 100; i++ {
+		id := RandomIDInRange(lower, upper)
+		if compare(id, lower) < 0 || compare(id, upper) > 0 {
+			t.Fatalf("id %x outside [%x, %x]", id, lower, upper)
+		}
+	}
+
+	// single-id range
+	if got := RandomIDInRange(lower, lower); got != lower {
+		t.Fatalf("expected %x, got %x", lower, got)
+	}
+}
@@ -0,0 +1,49 @@
+package node
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Loads the node id from path (40 hex chars). If the file does not exist a new random id is
+// generated and written there, so the node keeps its slice of the keyspace across restarts
+func LoadOrCreateID(path string) ([20]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		id, err := ParseID(string(raw))
+		if err != nil {
+			return id, fmt.Errorf("bad id file %s: %w", path, err)
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return [20]byte{}, err
+	}
+
+	var id [20]byte
+	for isZero(id) {
+		if _, err := rand.Read(id[:]); err != nil {
+			return id, fmt.Errorf("failed to generate node ID: %w", err)
+		}
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(id[:])+"\n"), 0o600); err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// the all-zero id means "unset" to OnSeen and the routing table, a node with it cannot be routed to
+var ErrZeroID = errors.New("node id must not be all zeros")
+
+// Parses a 40 char hex node id, surrounding whitespace is ignored
+func ParseID(s string) ([20]byte, error) {
+	id, err := decodeHexID(strings.TrimSpace(s))
+	if err == nil && isZero(id) {
+		return id, ErrZeroID
+	}
+	return id, err
+}
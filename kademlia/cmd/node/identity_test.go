@@ -0,0 +1,67 @@
+package node
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateID_CreatesThenReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.id")
+
+	first, err := LoadOrCreateID(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if isZero(first) {
+		t.Fatal("expected a random id, got zero")
+	}
+
+	second, err := LoadOrCreateID(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if first != second {
+		t.Fatalf("id changed across loads: %x vs %x", first, second)
+	}
+}
+
+func TestLoadOrCreateID_RejectsGarbage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.id")
+	if err := os.WriteFile(path, []byte("not-hex"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreateID(path); err == nil {
+		t.Fatal("expected error for a corrupt id file")
+	}
+}
+
+func TestParseID_RejectsZero(t *testing.T) {
+	zero := "0000000000000000000000000000000000000000"
+	if _, err := ParseID(zero); !errors.Is(err, ErrZeroID) {
+		t.Fatalf("expected ErrZeroID, got %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "node.id")
+	if err := os.WriteFile(path, []byte(zero+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreateID(path); !errors.Is(err, ErrZeroID) {
+		t.Fatalf("expected ErrZeroID for a zeroed id file, got %v", err)
+	}
+}
+
+func TestNewNodeWithID_UsesGivenID(t *testing.T) {
+	id, err := ParseID(" 00112233445566778899aabbccddeeff00112233\n")
+	if err != nil {
+		t.Fatalf("ParseID: %v", err)
+	}
+	n, err := NewNodeWithID("127.0.0.1:0", "", id, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if n.NodeID != id || n.Svc.SelfID != id || n.RoutingTable.SelfID != id {
+		t.Fatalf("node should use the given id everywhere, got %x", n.NodeID)
+	}
+}
@@ -3,23 +3,29 @@ package node
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 type Kbucket struct {
-	Capacity   int
-	LowerLimit [20]byte
-	UpperLimit [20]byte
-	Contacts   []Contact
-	mu         sync.RWMutex
+	Capacity       int
+	LowerLimit     [20]byte
+	UpperLimit     [20]byte
+	Contacts       []Contact
+	Replacements   []Contact // newcomers that did not fit, most recently seen last
+	ReplacementCap int
+	RefreshedAt    time.Time // last time we did a refresh lookup inside this bucket's range
+	mu             sync.RWMutex
 }
 
 // Creates a new kbucket
 func NewKBucket(k int, lower, upper [20]byte, collection []Contact) (Kbucket, error) {
 	return Kbucket{
-		Capacity:   k,
-		LowerLimit: lower,
-		UpperLimit: upper,
-		Contacts:   collection,
+		Capacity:       k,
+		LowerLimit:     lower,
+		UpperLimit:     upper,
+		Contacts:       collection,
+		ReplacementCap: k,
+		RefreshedAt:    time.Now(),
 	}, nil
 }
 
@@ -51,22 +57,102 @@ func (kb *Kbucket) RemoveFromKBucket(c Contact) error {
 	return nil
 }
 
-// Upserts a contact to the kbucket
-func (kb *Kbucket) Upsert(c Contact) {
+// Upserts a contact to the kbucket. If the bucket is full the newcomer is parked in the
+// replacement cache and the least-recently seen contact (head) is returned with full=true,
+// so the caller can ping it and decide whether it should be evicted.
+func (kb *Kbucket) Upsert(c Contact) (head Contact, full bool) {
 	kb.mu.Lock()
 	defer kb.mu.Unlock()
 
 	if kb.moveToTailIfExist(c) {
-		return
+		return Contact{}, false
 	}
 
 	if len(kb.Contacts) < kb.Capacity {
 		kb.Contacts = append(kb.Contacts, c)
-		return
+		return Contact{}, false
+	}
+
+	kb.addReplacementLocked(c)
+	return kb.Contacts[0], true
+}
+
+// Evicts a dead contact and backfills the bucket with the most recently seen replacement.
+// Returns false if the contact was not in the bucket.
+func (kb *Kbucket) EvictAndReplace(dead Contact) bool {
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+
+	idx := -1
+	for i := range kb.Contacts {
+		if kb.Contacts[i].ID == dead.ID {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return false
+	}
+	copy(kb.Contacts[idx:], kb.Contacts[idx+1:])
+	kb.Contacts = kb.Contacts[:len(kb.Contacts)-1]
+
+	if n := len(kb.Replacements); n > 0 {
+		kb.Contacts = append(kb.Contacts, kb.Replacements[n-1])
+		kb.Replacements = kb.Replacements[:n-1]
+	}
+	return true
+}
+
+// true if the bucket has no room for c and c is not already in it
+func (kb *Kbucket) isFullFor(c Contact) bool {
+	kb.mu.RLock()
+	defer kb.mu.RUnlock()
+	if len(kb.Contacts) < kb.Capacity {
+		return false
+	}
+	for i := range kb.Contacts {
+		if kb.Contacts[i].ID == c.ID {
+			return false
+		}
 	}
+	return true
+}
 
-	copy(kb.Contacts, kb.Contacts[1:])
-	kb.Contacts[len(kb.Contacts)-1] = c
+// Bumps the failure counter of the contact with the given address and returns the contact and its new count
+func (kb *Kbucket) recordFailureLocked(addr string) (Contact, int, bool) {
+	for i := range kb.Contacts {
+		if kb.Contacts[i].Addr == addr {
+			kb.Contacts[i].Failures++
+			return kb.Contacts[i], kb.Contacts[i].Failures, true
+		}
+	}
+	return Contact{}, 0, false
+}
+
+// Marks the contact with the given address as just seen and moves it to the tail, false if it is not here
+func (kb *Kbucket) recordSuccessLocked(addr string) bool {
+	for i := range kb.Contacts {
+		if kb.Contacts[i].Addr == addr {
+			c := kb.Contacts[i]
+			c.Touch()
+			kb.moveToTailIfExist(c)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the last time anything happened in this bucket: a contact was seen or the bucket was refreshed
+func (kb *Kbucket) LastTouched() time.Time {
+	kb.mu.RLock()
+	defer kb.mu.RUnlock()
+	last := kb.RefreshedAt
+	for _, c := range kb.Contacts {
+		if c.LastSeen.After(last) {
+			last = c.LastSeen
+		}
+	}
+	return last
 }
 
 // if the contact is already present in bucket, place it last (update for LRU-standard, essentially)
@@ -74,6 +160,10 @@ func (kb *Kbucket) moveToTailIfExist(c Contact) bool {
 	for i := range kb.Contacts {
 		if kb.Contacts[i].ID == c.ID {
 			temp := kb.Contacts[i]
+			if c.LastSeen.After(temp.LastSeen) {
+				temp.LastSeen = c.LastSeen
+				temp.Failures = 0
+			}
 			copy(kb.Contacts[i:], kb.Contacts[i+1:])
 			kb.Contacts[len(kb.Contacts)-1] = temp
 			return true
@@ -82,4 +172,21 @@ func (kb *Kbucket) moveToTailIfExist(c Contact) bool {
 	return false
 }
 
-//TODO
+// puts a contact last in the replacement cache, dropping the oldest one if the cache is full
+func (kb *Kbucket) addReplacementLocked(c Contact) {
+	for i := range kb.Replacements {
+		if kb.Replacements[i].ID == c.ID {
+			copy(kb.Replacements[i:], kb.Replacements[i+1:])
+			kb.Replacements = kb.Replacements[:len(kb.Replacements)-1]
+			break
+		}
+	}
+	if kb.ReplacementCap <= 0 {
+		return
+	}
+	if len(kb.Replacements) >= kb.ReplacementCap {
+		copy(kb.Replacements, kb.Replacements[1:])
+		kb.Replacements = kb.Replacements[:len(kb.Replacements)-1]
+	}
+	kb.Replacements = append(kb.Replacements, c)
+}
@@ -1,5 +1,9 @@
 package node
 
+import (
+	"testing"
+)
+
 // import (
 // 	"testing"
 // )
@@ -37,3 +41,71 @@ package node
 // 	}
 
 // }
+
+// helper: contact whose ID has the given first byte
+func contactWithFirstByte(b byte) Contact {
+	return Contact{ID: idWithFirstByte(b), Addr: "127.0.0.1:1"}
+}
+
+func TestKbucket_Upsert_FullBucketKeepsHeadAndCachesNewcomer(t *testing.T) {
+	var lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	kb, _ := NewKBucket(2, lower, upper, nil)
+
+	a, b, c := contactWithFirstByte(1), contactWithFirstByte(2), contactWithFirstByte(3)
+	if _, full := kb.Upsert(a); full {
+		t.Fatal("bucket should have room for a")
+	}
+	if _, full := kb.Upsert(b); full {
+		t.Fatal("bucket should have room for b")
+	}
+
+	head, full := kb.Upsert(c)
+	if !full {
+		t.Fatal("expected full=true when bucket is at capacity")
+	}
+	if head.ID != a.ID {
+		t.Fatalf("expected head to be a, got %x", head.ID[:1])
+	}
+	if len(kb.Contacts) != 2 || kb.Contacts[0].ID != a.ID || kb.Contacts[1].ID != b.ID {
+		t.Fatalf("full bucket should be untouched, got %+v", kb.Contacts)
+	}
+	if len(kb.Replacements) != 1 || kb.Replacements[0].ID != c.ID {
+		t.Fatalf("newcomer should be in replacement cache, got %+v", kb.Replacements)
+	}
+
+	// dead head gets replaced by the cached newcomer
+	if !kb.EvictAndReplace(a) {
+		t.Fatal("EvictAndReplace(a) should succeed")
+	}
+	if len(kb.Contacts) != 2 || kb.Contacts[0].ID != b.ID || kb.Contacts[1].ID != c.ID {
+		t.Fatalf("expected [b c] after eviction, got %+v", kb.Contacts)
+	}
+	if len(kb.Replacements) != 0 {
+		t.Fatalf("replacement cache should be drained, got %+v", kb.Replacements)
+	}
+}
+
+func TestKbucket_ReplacementCacheIsBounded(t *testing.T) {
+	var lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	kb, _ := NewKBucket(1, lower, upper, nil)
+	kb.ReplacementCap = 2
+
+	kb.Upsert(contactWithFirstByte(1))
+	kb.Upsert(contactWithFirstByte(2))
+	kb.Upsert(contactWithFirstByte(3))
+	kb.Upsert(contactWithFirstByte(4))
+	kb.Upsert(contactWithFirstByte(3)) // seen again -> moves to the end, no duplicate
+
+	if len(kb.Replacements) != 2 {
+		t.Fatalf("expected 2 replacements, got %d", len(kb.Replacements))
+	}
+	if kb.Replacements[0].ID[0] != 4 || kb.Replacements[1].ID[0] != 3 {
+		t.Fatalf("expected replacements [4 3], got [%d %d]", kb.Replacements[0].ID[0], kb.Replacements[1].ID[0])
+	}
+}
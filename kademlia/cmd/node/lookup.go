@@ -13,6 +13,7 @@ type slEntry struct {
 	c   Contact
 	d   [20]byte // XOR distance to target
 	ask bool     // already queried?
+	ans bool     // answered with contacts (i.e. did not have the value)?
 }
 
 type shortlist struct {
@@ -30,7 +31,7 @@ func newShortlist(target [20]byte, k int) *shortlist {
 		k:      k,
 		idx:    make(map[[20]byte]int),
 		list:   make([]slEntry, 0, k*2),
-		max:    k,
+		max:    k * 3, // keep spares beyond k so contacts that fail can be replaced
 	}
 }
 
@@ -63,6 +64,23 @@ func (s *shortlist) add(cs []Contact) (changed bool) {
 	return changed
 }
 
+// returns the ids in cs that are not in the shortlist yet
+func (s *shortlist) unknown(cs []Contact) [][20]byte {
+	var out [][20]byte
+	for _, c := range cs {
+		if _, ok := s.idx[c.ID]; !ok {
+			out = append(out, c.ID)
+		}
+	}
+	return out
+}
+
+// reports whether id is in the shortlist
+func (s *shortlist) has(id [20]byte) bool {
+	_, ok := s.idx[id]
+	return ok
+}
+
 // Rebuilds the index map from the list
 func (s *shortlist) rebuildIndex() {
 	s.idx = make(map[[20]byte]int, len(s.list))
@@ -71,10 +89,13 @@ func (s *shortlist) rebuildIndex() {
 	}
 }
 
-// nextBatch returns alpha closest UNQUIERIED contacts and marks them
+// nextBatch returns alpha closest UNQUIERIED contacts among the k closest and marks them
 func (s *shortlist) nextBatch(a int) []Contact {
 	out := make([]Contact, 0, a)
 	for i := range s.list {
+		if i >= s.k {
+			break
+		}
 		if !s.list[i].ask {
 			out = append(out, s.list[i].c)
 			s.list[i].ask = true
@@ -86,6 +107,35 @@ func (s *shortlist) nextBatch(a int) []Contact {
 	return out
 }
 
+// remove drops a contact that failed to answer, the next closest spare moves up into the k closest
+func (s *shortlist) remove(id [20]byte) {
+	i, ok := s.idx[id]
+	if !ok {
+		return
+	}
+	copy(s.list[i:], s.list[i+1:])
+	s.list = s.list[:len(s.list)-1]
+	s.rebuildIndex()
+}
+
+// marks a contact as having answered our query
+func (s *shortlist) markAnswered(id [20]byte) {
+	if i, ok := s.idx[id]; ok {
+		s.list[i].ans = true
+	}
+}
+
+// returns the closest contact that answered without the value (skipping 'except'), together with
+// how many contacts in the shortlist sit between it and the target
+func (s *shortlist) closestAnswered(except [20]byte) (Contact, int, bool) {
+	for i := range s.list {
+		if s.list[i].ans && s.list[i].c.ID != except {
+			return s.list[i].c, i, true
+		}
+	}
+	return Contact{}, 0, false
+}
+
 // improved returns true if the best distance became strictly smaller.
 func (s *shortlist) improved(prevBest [20]byte) bool {
 	if len(s.list) == 0 {
@@ -106,10 +156,14 @@ func (s *shortlist) best() [20]byte {
 	return s.list[0].d
 }
 
-// returns all contacts in the shortlist
+// returns the k closest contacts in the shortlist
 func (s *shortlist) contacts() []Contact {
-	out := make([]Contact, len(s.list))
-	for i := range s.list {
+	n := len(s.list)
+	if n > s.k {
+		n = s.k
+	}
+	out := make([]Contact, n)
+	for i := 0; i < n; i++ {
 		out[i] = s.list[i].c
 	}
 	return out
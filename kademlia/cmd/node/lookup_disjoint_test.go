@@ -0,0 +1,137 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Limpowitch/D7024E-Lab-Assignment/kademlia/service"
+)
+
+func TestRunDisjointLookup_NoContactQueriedTwice(t *testing.T) {
+	n := &Node{NodeID: RandomNodeID(), DisjointPaths: 3}
+	var target [20]byte
+
+	var seeds []Contact
+	for i := 1; i <= 9; i++ {
+		seeds = append(seeds, contactWithFirstByte(byte(i)))
+	}
+	// every peer suggests the same extra contacts, each path would normally ask them too
+	var shared []Contact
+	for i := 0x40; i < 0x48; i++ {
+		shared = append(shared, contactWithFirstByte(byte(i)))
+	}
+
+	var mu sync.Mutex
+	asked := map[[20]byte]int{}
+	res, err := n.runDisjointLookup(context.Background(), target, seeds, fixedTimeout(time.Second), func(ctx context.Context, c Contact) (queryResult, error) {
+		mu.Lock()
+		asked[c.ID]++
+		mu.Unlock()
+		return queryResult{contacts: shared}, nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	for id, times := range asked {
+		if times != 1 {
+			t.Fatalf("contact %x was queried %d times", id[:1], times)
+		}
+	}
+	if len(asked) != len(seeds)+len(shared) {
+		t.Fatalf("expected all %d contacts to be queried once, got %d", len(seeds)+len(shared), len(asked))
+	}
+	if len(res.contacts) != len(seeds)+len(shared) {
+		t.Fatalf("expected merged result of %d contacts, got %d", len(seeds)+len(shared), len(res.contacts))
+	}
+}
+
+// a node that lies: FIND_NODE and FIND_VALUE always answer with made up contacts that look very close
+// to whatever was asked for, but all point back at the liar itself
+func startLiar(t *testing.T, id [20]byte) Contact {
+	t.Helper()
+	svc, err := service.New("127.0.0.1:0", id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakes := func(target [20]byte) []byte {
+		var cs []Contact
+		for i := 0; i < K; i++ {
+			fake := target
+			fake[18] ^= byte(i + 1)
+			cs = append(cs, Contact{ID: fake, Addr: svc.Addr()})
+		}
+		return MarshalContactList(cs)
+	}
+	svc.OnFindNode = fakes
+	svc.OnFindValue = func(key [20]byte) ([]byte, []byte) { return nil, fakes(key) }
+	svc.Start()
+	t.Cleanup(func() { _ = svc.Close() })
+	return Contact{ID: id, Addr: svc.Addr()}
+}
+
+// sets up the network of TestDisjointLookup_SucceedsWithLyingNodes: honest nodes that all know
+// each other with the key on one of them, and seeds for the querier of which a third are liars.
+// with nearKey the liars pick ids right next to the key, so they are the first seeds asked
+func lyingNetwork(t *testing.T, nearKey bool) (querier *Node, key [20]byte, seeds []Contact) {
+	t.Helper()
+	const honest = 12
+	nodes := startNodes(t, honest+1)
+	querier, net := nodes[0], nodes[1:]
+
+	// honest nodes all know each other, but the querier only knows half of them (not the holder)
+	for _, nd := range net {
+		for _, other := range net {
+			nd.RoutingTable.Update(Contact{ID: other.NodeID, Addr: other.Svc.Addr()})
+		}
+	}
+
+	key = SHA1ID([]byte("safe"))
+	holder := net[len(net)-1]
+	_ = holder.Store.Put(key, Value{Data: []byte("safe"), ExpiresAt: time.Now().Add(time.Minute)})
+
+	// a third of the contacts the querier starts from are liars. they are passed as seeds on every
+	// run, the routing table itself fills up with the liars' fake contacts after the first lookup
+	for i := 0; i < 3; i++ {
+		id := RandomNodeID()
+		if nearKey {
+			id = key
+			id[19] ^= byte(i + 1)
+		}
+		seeds = append(seeds, startLiar(t, id))
+	}
+	for _, nd := range net[:6] {
+		seeds = append(seeds, Contact{ID: nd.NodeID, Addr: nd.Svc.Addr()})
+	}
+	querier.CacheOnLookup = false
+	return querier, key, seeds
+}
+
+func TestDisjointLookup_SucceedsWithLyingNodes(t *testing.T) {
+	querier, key, seeds := lyingNetwork(t, false)
+	querier.DisjointPaths = 3
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		val, _, err := querier.GetValueIterative(ctx, key, seeds)
+		cancel()
+		if err != nil || string(val) != "safe" {
+			t.Fatalf("run %d: lookup with disjoint paths failed: %q %v", i, val, err)
+		}
+	}
+}
+
+// the same network with a single path: the liars are asked first and their fake contacts push
+// the honest ones out of the shortlist, so the plain lookup never reaches the holder
+func TestDisjointLookup_SinglePathIsMisledByLyingNodes(t *testing.T) {
+	querier, key, seeds := lyingNetwork(t, true)
+	querier.DisjointPaths = 1
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		val, _, err := querier.GetValueIterative(ctx, key, seeds)
+		cancel()
+		if err == nil && string(val) == "safe" {
+			t.Fatalf("run %d: expected the liars to make the single path lookup fail", i)
+		}
+	}
+}
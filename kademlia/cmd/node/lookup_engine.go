@@ -0,0 +1,217 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// what asking one peer gave us
+type queryResult struct {
+	contacts []Contact // closer contacts suggested by the peer
+	value    []byte    // set (with found) if the peer had the value we look for
+	found    bool
+}
+
+// asks one peer, used by the engine for both FIND_NODE and FIND_VALUE lookups
+type queryFunc func(ctx context.Context, c Contact) (queryResult, error)
+
+// how long the engine waits for one peer, normally Node.rpcTimeout
+type timeoutFunc func(c Contact) time.Duration
+
+// what a finished lookup gave us
+type lookupResult struct {
+	contacts []Contact // k closest live contacts seen
+	value    []byte
+	found    bool
+	from     Contact // who answered with the value
+
+	// closest contact that answered without the value, and how many shortlist contacts sit
+	// between it and the key. set when found, used for lookup path caching
+	cacheAt  Contact
+	between  int
+	hasCache bool
+}
+
+// one answer (or failure) coming back from a peer
+type queryReply struct {
+	c    Contact
+	res  queryResult
+	err  error
+	sent time.Time
+	rtt  time.Duration
+}
+
+// runLookup is the lookup engine shared by LookupNode and GetValueIterative.
+//
+// instead of lock-step rounds it keeps alpha queries in flight at all times: whenever an answer or a
+// timeout comes back the next closest unqueried contact is asked right away, so one slow peer only
+// holds up its own slot (for at most rpcTimeout(c)). if alpha answers in a row fail to get us closer
+// to the target, the window opens to k and every remaining contact in the k closest is asked (the
+// paper's end game). the
+// lookup ends when all of the k closest have answered or failed, when a value is found, or when ctx
+// is done. contacts that fail are dropped from the shortlist. if tr is set every answer is recorded in it.
+func (n *Node) runLookup(ctx context.Context, sl *shortlist, rpcTimeout timeoutFunc, query queryFunc, tr *pathTrace) (lookupResult, error) {
+	replies := make(chan queryReply)
+	done := make(chan struct{})
+	defer close(done) // late answers are dropped once we return
+
+	inFlight := 0
+	stale := 0 // answers in a row that did not improve the closest distance
+	for {
+		window := alpha
+		if stale >= alpha {
+			window = K
+		}
+		for inFlight < window {
+			next := sl.nextBatch(1)
+			if len(next) == 0 {
+				break
+			}
+			inFlight++
+			go func(c Contact) {
+				// the rpc has a deadline of its own and the lookup only ever cancels it, so the end of the
+				// lookup (or its deadline) is not counted as a timeout against the peers still in flight
+				rctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rpcTimeout(c))
+				stop := context.AfterFunc(ctx, cancel)
+				sent := time.Now()
+				res, err := query(rctx, c)
+				rtt := time.Since(sent)
+				stop()
+				cancel()
+				select {
+				case replies <- queryReply{c: c, res: res, err: err, sent: sent, rtt: rtt}:
+				case <-done:
+				}
+			}(next[0])
+		}
+		if inFlight == 0 {
+			// nothing left to ask, all of the k closest have answered (or were dropped)
+			return lookupResult{contacts: sl.contacts()}, nil
+		}
+
+		select {
+		case r := <-replies:
+			inFlight--
+			hop := TraceHop{Peer: traceContact(r.c), RTTMs: sinceMs(r.rtt)}
+			if r.err != nil {
+				dropped := ctx.Err() == nil
+				if dropped {
+					sl.remove(r.c.ID) // peer timeout or network error → drop it
+				}
+				stale++
+				if !errors.Is(r.err, errClaimed) {
+					hop.Error, hop.Dropped = r.err.Error(), dropped
+					tr.hop(hop, r.sent, nil)
+				}
+				continue
+			}
+			if r.res.found {
+				hop.Found = true
+				tr.hop(hop, r.sent, nil)
+				res := lookupResult{contacts: sl.contacts(), value: r.res.value, found: true, from: r.c}
+				res.cacheAt, res.between, res.hasCache = sl.closestAnswered(r.c.ID)
+				return res, nil
+			}
+			sl.markAnswered(r.c.ID)
+			prevBest := sl.best()
+			var fresh [][20]byte
+			if tr != nil {
+				fresh = sl.unknown(r.res.contacts)
+			}
+			sl.add(r.res.contacts)
+			if sl.improved(prevBest) {
+				stale = 0
+				hop.Improved = true
+			} else {
+				stale++
+			}
+			if tr != nil {
+				for _, id := range fresh {
+					if sl.has(id) {
+						hop.Added++
+					}
+				}
+				if len(sl.list) > 0 {
+					hop.Best = traceContact(sl.list[0].c).ID
+				}
+				tr.hop(hop, r.sent, r.res.contacts)
+			}
+
+		case <-ctx.Done():
+			return lookupResult{contacts: sl.contacts()}, ctx.Err()
+		}
+	}
+}
+
+var errClaimed = errors.New("contact already queried by another path")
+
+// runs the lookup over n.DisjointPaths disjoint paths (S/Kademlia). the seeds are dealt out over the
+// paths, each path has its own shortlist and no contact is ever queried by two paths, so a bad node
+// that feeds us fake contacts can only steer the path that asked it. node results are merged into
+// one k closest list; a value lookup returns as soon as any path finds the value. tr may be nil.
+func (n *Node) runDisjointLookup(ctx context.Context, target [20]byte, seeds []Contact, rpcTimeout timeoutFunc, query queryFunc, tr *LookupTrace) (lookupResult, error) {
+	d := n.DisjointPaths
+	if d <= 1 {
+		sl := newShortlist(target, K)
+		sl.add(seeds)
+		return n.runLookup(ctx, sl, rpcTimeout, query, tr.path(0))
+	}
+
+	// sort the seeds by distance first, so every path gets some close ones
+	all := newShortlist(target, len(seeds))
+	all.add(seeds)
+	seeds = all.contacts()
+
+	var mu sync.Mutex
+	claimed := make(map[[20]byte]bool)
+	claim := func(c Contact) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if claimed[c.ID] {
+			return false
+		}
+		claimed[c.ID] = true
+		return true
+	}
+
+	pctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type pathResult struct {
+		res lookupResult
+		err error
+	}
+	results := make(chan pathResult, d)
+	for p := 0; p < d; p++ {
+		sl := newShortlist(target, K)
+		for i := p; i < len(seeds); i += d {
+			sl.add([]Contact{seeds[i]})
+		}
+		go func(sl *shortlist, pt *pathTrace) {
+			res, err := n.runLookup(pctx, sl, rpcTimeout, func(ctx context.Context, c Contact) (queryResult, error) {
+				if !claim(c) {
+					return queryResult{}, errClaimed
+				}
+				return query(ctx, c)
+			}, pt)
+			results <- pathResult{res, err}
+		}(sl, tr.path(p))
+	}
+
+	merged := newShortlist(target, K)
+	var firstErr error
+	for p := 0; p < d; p++ {
+		r := <-results
+		if r.res.found {
+			cancel() // the other paths can stop
+			return r.res, nil
+		}
+		if r.err != nil && firstErr == nil {
+			firstErr = r.err
+		}
+		merged.add(r.res.contacts)
+	}
+	return lookupResult{contacts: merged.contacts()}, firstErr
+}
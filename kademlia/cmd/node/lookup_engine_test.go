@@ -0,0 +1,82 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fixedTimeout(d time.Duration) timeoutFunc {
+	return func(Contact) time.Duration { return d }
+}
+
+func TestRunLookup_SlowPeerDoesNotStallOthers(t *testing.T) {
+	n := &Node{NodeID: RandomNodeID()}
+	var target [20]byte
+	sl := newShortlist(target, K)
+	var cs []Contact
+	for i := 1; i <= 10; i++ {
+		cs = append(cs, contactWithFirstByte(byte(i)))
+	}
+	sl.add(cs)
+	slow := cs[0].ID
+
+	var mu sync.Mutex
+	started := map[[20]byte]time.Duration{}
+	begin := time.Now()
+
+	res, err := n.runLookup(context.Background(), sl, fixedTimeout(300*time.Millisecond), func(ctx context.Context, c Contact) (queryResult, error) {
+		mu.Lock()
+		started[c.ID] = time.Since(begin)
+		mu.Unlock()
+		if c.ID == slow {
+			<-ctx.Done() // never answers
+			return queryResult{}, ctx.Err()
+		}
+		time.Sleep(10 * time.Millisecond)
+		return queryResult{}, nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+
+	if len(started) != len(cs) {
+		t.Fatalf("expected every contact to be queried, got %d", len(started))
+	}
+	for id, at := range started {
+		if id != slow && at > 200*time.Millisecond {
+			t.Fatalf("contact %x was only queried after %v, the slow peer stalled the lookup", id[:1], at)
+		}
+	}
+	for _, c := range res.contacts {
+		if c.ID == slow {
+			t.Fatal("the peer that timed out should be dropped from the result")
+		}
+	}
+	if len(res.contacts) != len(cs)-1 {
+		t.Fatalf("expected %d live contacts, got %d", len(cs)-1, len(res.contacts))
+	}
+}
+
+func TestRunLookup_StopsOnValue(t *testing.T) {
+	n := &Node{NodeID: RandomNodeID()}
+	var target [20]byte
+	sl := newShortlist(target, K)
+	holder := contactWithFirstByte(5)
+	sl.add([]Contact{contactWithFirstByte(1), contactWithFirstByte(2), holder})
+
+	res, err := n.runLookup(context.Background(), sl, fixedTimeout(time.Second), func(ctx context.Context, c Contact) (queryResult, error) {
+		if c.ID == holder.ID {
+			return queryResult{value: []byte("v"), found: true}, nil
+		}
+		// point everyone towards the holder
+		return queryResult{contacts: []Contact{holder}}, nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if !res.found || string(res.value) != "v" || res.from.ID != holder.ID {
+		t.Fatalf("expected value from holder, got %+v", res)
+	}
+}
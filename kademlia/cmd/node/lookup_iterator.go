@@ -1,77 +1,39 @@
 package node
 
-import (
-	"context"
-	"sync"
-	"time"
-)
+import "context"
 
-// iterative lookup for target. returns K-closest contacts it discovers
+// iterative lookup for target. returns the K closest live contacts it discovers.
+// runs on the sliding-window engine (see runLookup), over disjoint paths if DisjointPaths > 1: it ends
+// when every one of the k closest has been queried and answered, contacts that fail are dropped so the
+// result only holds live nodes.
 func (n *Node) LookupNode(ctx context.Context, target [20]byte) ([]Contact, error) {
-	sl := newShortlist(target, K)
-
 	// seed with current routing table
-	sl.add(n.RoutingTable.Closest(target, K))
-
-	// if empty, we can still try any bootstrap peers you may have separately.
-	//prevBest := sl.best()
-
-	progressed := false
-
-	for {
-		batch := sl.nextBatch(alpha)
-		if len(batch) == 0 {
-			// nothing left to ask
-			break
-		}
-
-		progressed = false
-
-		// alpha parallel. each response adds more contacts.
-		var wg sync.WaitGroup
-		var mu sync.Mutex // guard merging into shortlist
-		wg.Add(len(batch))
-
-		for _, c := range batch {
-			c := c
-			go func() {
-				defer wg.Done()
+	seeds := n.RoutingTable.Closest(target, K)
 
-				// one-RPC timeout per peer (don’t block the whole lookup)
-				rpcCtx, cancel := context.WithTimeout(ctx, 800*time.Millisecond)
-				defer cancel()
-
-				raw, err := n.Svc.FindNode(rpcCtx, c.Addr, target)
-				if err != nil {
-					return // timeout or network error → skip
-				}
-				contacts, err := UnmarshalContactList(raw)
-				if err != nil {
-					return
-				}
-
-				// after you unmarshal contacts from a FIND_NODE_RESP
-				for _, c := range contacts {
-					n.RoutingTable.Update(c) // add/refresh each suggested contact
-				}
+	res, err := n.runDisjointLookup(ctx, target, seeds, n.rpcTimeout, func(ctx context.Context, c Contact) (queryResult, error) {
+		contacts, err := n.findNodeRPC(ctx, c, target)
+		return queryResult{contacts: contacts}, err
+	}, nil)
+	return res.contacts, err
+}
 
-				// update our routing table when we talk to someone.
-				n.RoutingTable.Update(Contact{ID: c.ID, Addr: c.Addr})
+// sends one FIND_NODE to c and returns the contacts it suggested, minus ourselves
+func (n *Node) findNodeRPC(ctx context.Context, c Contact, target [20]byte) ([]Contact, error) {
+	raw, err := n.Svc.FindNode(ctx, c.Addr, target)
+	if err != nil {
+		return nil, err
+	}
+	contacts, err := UnmarshalContactList(raw)
+	if err != nil {
+		return nil, err
+	}
 
-				// finally merge into shortlist
-				mu.Lock()
-				if sl.add(contacts) {
-					progressed = true
-				}
-				mu.Unlock()
-			}()
-		}
-		wg.Wait()
+	// update our routing table when we talk to someone.
+	n.RoutingTable.Touch(Contact{ID: c.ID, Addr: c.Addr})
 
-		if !progressed {
-			break
-		}
+	contacts = usableContacts(n.NodeID, contacts)
+	for _, sc := range contacts {
+		n.RoutingTable.Update(sc) // add/refresh each suggested contact
 	}
-
-	return sl.contacts(), nil
+	return contacts, nil
 }
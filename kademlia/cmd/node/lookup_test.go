@@ -1,5 +1,11 @@
 package node
 
+import (
+	"context"
+	"testing"
+	"time"
+)
+
 // import (
 // 	"context"
 // 	"testing"
@@ -66,3 +72,113 @@ package node
 // 		t.Fatalf("expected to find D among closest, got: %+v", contacts)
 // 	}
 // }
+
+// starts n nodes on loopback, closed when the test ends
+func startNodes(t *testing.T, n int) []*Node {
+	t.Helper()
+	return startNodesWith(t, n, nil)
+}
+
+// like startNodes, setup (if not nil) gets to change each node before it starts serving
+func startNodesWith(t *testing.T, n int, setup func(*Node)) []*Node {
+	t.Helper()
+	out := make([]*Node, n)
+	for i := range out {
+		nd, err := NewNode("127.0.0.1:0", "", 10*time.Second, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd.BucketRefresh = 0
+		if setup != nil {
+			setup(nd)
+		}
+		nd.Svc.Start()
+		t.Cleanup(func() { _ = nd.Close() })
+		out[i] = nd
+	}
+	return out
+}
+
+func TestShortlist_RemoveAndBatchWithinK(t *testing.T) {
+	var target [20]byte
+	sl := newShortlist(target, 2)
+	a, b, c := contactWithFirstByte(1), contactWithFirstByte(2), contactWithFirstByte(3)
+	sl.add([]Contact{c, a, b})
+
+	batch := sl.nextBatch(5)
+	if len(batch) != 2 || batch[0].ID != a.ID || batch[1].ID != b.ID {
+		t.Fatalf("expected only the 2 closest to be handed out, got %+v", batch)
+	}
+	if more := sl.nextBatch(5); len(more) != 0 {
+		t.Fatalf("spare beyond k should not be queried yet, got %+v", more)
+	}
+
+	// a fails -> c moves up into the k closest and becomes queryable
+	sl.remove(a.ID)
+	if more := sl.nextBatch(5); len(more) != 1 || more[0].ID != c.ID {
+		t.Fatalf("expected c after removing a, got %+v", more)
+	}
+	if got := sl.contacts(); len(got) != 2 || got[0].ID != b.ID || got[1].ID != c.ID {
+		t.Fatalf("expected [b c], got %+v", got)
+	}
+}
+
+func TestLookupNode_FindsAllLiveNodesAndDropsDead(t *testing.T) {
+	nodes := startNodes(t, 8)
+
+	// chain: each node only knows the next one, so the lookup has to walk the whole network
+	for i := 0; i < len(nodes)-1; i++ {
+		nodes[i].RoutingTable.Update(Contact{ID: nodes[i+1].NodeID, Addr: nodes[i+1].Svc.Addr()})
+	}
+	// a dead contact right next to the target, nobody listens on its address
+	target := nodes[len(nodes)-1].NodeID
+	dead := Contact{ID: target, Addr: "127.0.0.1:1"}
+	dead.ID[19] ^= 1
+	nodes[0].RoutingTable.Update(dead)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, err := nodes[0].LookupNode(ctx, target)
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+
+	seen := map[[20]byte]bool{}
+	for _, c := range got {
+		if c.ID == dead.ID {
+			t.Fatal("dead contact should have been dropped from the result")
+		}
+		seen[c.ID] = true
+	}
+	for _, nd := range nodes[1:] {
+		if !seen[nd.NodeID] {
+			t.Fatalf("expected %x in the result, got %d contacts", nd.NodeID[:4], len(got))
+		}
+	}
+	if seen[nodes[0].NodeID] {
+		t.Fatal("the lookup should not return the node itself")
+	}
+	if got[0].ID != target {
+		t.Fatalf("expected target first, got %x", got[0].ID[:4])
+	}
+}
+
+func TestLookupTimeout_FollowsTheRTOBounds(t *testing.T) {
+	n, err := NewNode("127.0.0.1:0", "", time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	target := RandomNodeID()
+
+	// no contacts and no samples: InitialRTO, kept within -rto-min and -rto-max
+	n.Svc.MinRTO, n.Svc.MaxRTO = 100*time.Millisecond, 300*time.Millisecond
+	if got := n.LookupTimeout(target); got != lookupRounds*300*time.Millisecond {
+		t.Fatalf("want %v, got %v", lookupRounds*300*time.Millisecond, got)
+	}
+	n.RoutingTable.Update(Contact{ID: RandomNodeID(), Addr: "127.0.0.1:1"})
+	n.Svc.MinRTO, n.Svc.MaxRTO = 2*time.Second, 5*time.Second
+	if got := n.LookupTimeout(target); got != lookupRounds*2*time.Second {
+		t.Fatalf("want %v, got %v", lookupRounds*2*time.Second, got)
+	}
+}
@@ -3,10 +3,12 @@ package node
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -15,22 +17,44 @@ import (
 
 const K = 20 // bucket size
 
+// values are content addressed, their key is SHA1ID(value). STORE, CACHE and lookups all check it
+var ErrKeyMismatch = errors.New("value does not hash to its key")
+
 // A Kademlia node
 type Node struct {
 	NodeID       [20]byte
 	Addr         string // bind addr we listen on (e.g. "127.0.0.1:9999")
 	RoutingTable *RoutingTable
-	Store        map[string]Value
+	Store        Storage // values we hold, MemoryStore unless replaced before Start
 	Svc          *service.Service
 	adv          string
-	ttl          time.Duration // how long values live
+	ttl          time.Duration // how long values live unless their publisher asks otherwise
 	refreshEvery time.Duration // how often origin republisher runs
 
+	BucketRefresh time.Duration // buckets not touched for this long get a lookup for a random id in their range
+	StateFile     string        // if set, the routing table is saved here and reloaded on start
+	StateEvery    time.Duration // how often the routing table is saved to StateFile
+	CacheOnLookup bool          // cache found values at the closest node on the lookup path that did not have them
+	CacheTTL      time.Duration // ttl of a cached copy right next to the key, halved per node further away
+	DisjointPaths int           // number of disjoint lookup paths (S/Kademlia), 1 = plain single path lookups
+	MaxTTL        time.Duration // longest ttl a publisher may ask for in STORE or ADMIN_PUT
+	Republish     time.Duration // replicas not received for this long are stored again at the K closest, 0 disables
+
 	mu sync.RWMutex
 }
 
-// Creates a new node
+// Creates a new node with a random id
 func NewNode(bind string, adv string, ttl time.Duration, refreshEvery time.Duration) (*Node, error) {
+	// generate a random 160-bit node ID
+	var id [20]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate node ID: %w", err)
+	}
+	return NewNodeWithID(bind, adv, id, ttl, refreshEvery)
+}
+
+// Creates a new node with the given id (e.g. loaded with LoadOrCreateID)
+func NewNodeWithID(bind string, adv string, id [20]byte, ttl time.Duration, refreshEvery time.Duration) (*Node, error) {
 	if refreshEvery <= 0 {
 		refreshEvery = ttl / 2
 		if refreshEvery <= 0 {
@@ -38,12 +62,6 @@ func NewNode(bind string, adv string, ttl time.Duration, refreshEvery time.Durat
 		}
 	}
 
-	// generate a random 160-bit node ID
-	var id [20]byte
-	if _, err := rand.Read(id[:]); err != nil {
-		return nil, fmt.Errorf("failed to generate node ID: %w", err)
-	}
-
 	// full ID space [0..2^160-1]
 	var lower, upper [20]byte
 	for i := range upper {
@@ -64,33 +82,61 @@ func NewNode(bind string, adv string, ttl time.Duration, refreshEvery time.Durat
 	n := &Node{
 		NodeID:       id,
 		Addr:         bind,
-		RoutingTable: &rt,
-		Store:        make(map[string]Value),
+		RoutingTable: rt,
+		Store:        NewMemoryStore(),
 		Svc:          svc,
 		adv:          adv,
 		ttl:          ttl,
 		refreshEvery: refreshEvery,
+
+		BucketRefresh: time.Hour,
+		StateEvery:    time.Minute,
+		CacheOnLookup: true,
+		CacheTTL:      ttl / 4,
+		DisjointPaths: 1,
+		MaxTTL:        ttl,
+		Republish:     time.Hour,
 	}
 
-	n.Svc.OnRefresh = func(key [20]byte) {
-		n.mu.Lock()
-		if v, ok := n.Store[string(key[:])]; ok {
-			v.ExpiresAt = time.Now().Add(n.ttl)
-			n.Store[string(key[:])] = v
+	// full buckets ping their least-recently seen contact before evicting it
+	n.RoutingTable.Ping = func(c Contact) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), n.rpcTimeout(c))
+		defer cancel()
+		return n.Svc.Ping(ctx, c.Addr) == nil
+	}
+
+	// count failed RPCs per contact, dead peers get evicted once they pass RoutingTable.MaxFailures
+	n.Svc.OnRPCDone = func(addr string, err error) {
+		if err != nil {
+			n.RoutingTable.RecordFailure(addr)
+			return
 		}
-		n.mu.Unlock()
+		n.RoutingTable.RecordSuccess(addr)
 	}
 
-	n.Svc.OnAdminForget = func(key [20]byte) bool {
-		n.mu.Lock()
-		defer n.mu.Unlock()
-		if _, ok := n.Store[string(key[:])]; !ok {
+	// a cached copy does not count as holding the key, the publisher should STORE a real replica
+	n.Svc.OnRefresh = func(key [20]byte) bool {
+		v, ok := n.Store.Get(key)
+		if !ok || v.Cached {
 			return false
 		}
-		delete(n.Store, string(key[:]))
+		if v.Origin {
+			return true // our own value, its expiry is the publisher's and not a replica's
+		}
+		if _, err := n.Store.Touch(key, time.Now().Add(n.replicaTTL(key, v.TTL))); err != nil {
+			log.Printf("[node] refresh key=%x: %v", key[:4], err)
+		}
 		return true
 	}
 
+	n.Svc.OnAdminForget = func(key [20]byte) bool {
+		ok, err := n.Store.Delete(key)
+		if err != nil {
+			log.Printf("[node] forget key=%x: %v", key[:4], err)
+		}
+		return ok
+	}
+
 	n.Svc.OnExit = func() {
 		// need to unblock signal is serve. so we self signal:
 		p, _ := os.FindProcess(os.Getpid())
@@ -98,47 +144,39 @@ func NewNode(bind string, adv string, ttl time.Duration, refreshEvery time.Durat
 	}
 
 	// ADMIN_PUT: compute key, do lookup(key), store to K closest, return key.
-	n.Svc.OnAdminPut = func(value []byte) ([20]byte, error) {
+	n.Svc.OnAdminPut = func(value []byte, ttl time.Duration) ([20]byte, error) {
 		key := SHA1ID(value)
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ttl = n.valueTTL(ttl)
+
+		// our own origin copy goes in first: if the store has no room for it the put fails before
+		// anything went out to the network
+		origin := Value{
+			Data:        value,
+			Origin:      true,
+			LastPublish: time.Now(),
+			ExpiresAt:   time.Now().Add(ttl),
+			TTL:         ttl,
+		}
+		if err := n.Store.Put(key, origin); err != nil {
+			return key, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.LookupTimeout(key))
 		defer cancel()
 		_, _ = n.LookupNode(ctx, key)
-
 		cs := n.RoutingTable.Closest(key, K)
-		if len(cs) == 0 {
-			n.mu.Lock()
-			n.Store[string(key[:])] = Value{
-				Data:        append([]byte(nil), value...),
-				Origin:      true,
-				LastPublish: time.Now(),
-				ExpiresAt:   time.Now().Add(n.ttl),
-			}
-			n.mu.Unlock()
-			return key, nil
-		}
 
 		var wg sync.WaitGroup
 		for _, c := range cs {
 			wg.Add(1)
 			go func(addr string) {
 				defer wg.Done()
-				ctx2, cancel2 := context.WithTimeout(context.Background(), 800*time.Millisecond)
-				_ = n.Svc.Store(ctx2, addr, key, value)
+				ctx2, cancel2 := context.WithTimeout(context.Background(), n.Svc.RTO(addr))
+				_ = n.Svc.Store(ctx2, addr, key, value, ttl)
 				cancel2()
 			}(c.Addr)
 		}
 		wg.Wait()
-
-		// keep a local origin copy too (optional but convenient)
-		n.mu.Lock()
-		n.Store[string(key[:])] = Value{
-			Data:        append([]byte(nil), value...),
-			Origin:      true,
-			LastPublish: time.Now(),
-			ExpiresAt:   time.Now().Add(n.ttl),
-		}
-		n.mu.Unlock()
-
 		return key, nil
 	}
 
@@ -146,24 +184,30 @@ func NewNode(bind string, adv string, ttl time.Duration, refreshEvery time.Durat
 	// node/node.go (inside NewNode)
 	n.Svc.OnAdminGet = func(ctx context.Context, key [20]byte) ([]byte, bool) {
 		// Local fast path
-		n.mu.RLock()
-		if v, ok := n.Store[string(key[:])]; ok && len(v.Data) > 0 {
-			out := append([]byte(nil), v.Data...)
-			n.mu.RUnlock()
-			return out, true
+		if v, ok := n.Store.Get(key); ok {
+			return append([]byte{}, v.Data...), true
 		}
-		n.mu.RUnlock()
 
 		seeds := n.RoutingTable.Closest(key, K) // fine if empty
 		val, _, err := n.GetValueIterative(ctx, key, seeds)
-		if err == nil && val != "" {
-			return []byte(val), true
+		if err == nil {
+			return val, true
 		}
 		// Optional: log for clarity — you already have similar logs.
 		// log.Printf("[admin-get] MISS err=%v", err)
 		return nil, false
 	}
 
+	// ADMIN_TRACE: same lookup as ADMIN_GET (without the local fast path) but recording every hop
+	n.Svc.OnAdminTrace = func(ctx context.Context, key [20]byte, max int) []byte {
+		raw, err := n.TraceLookup(ctx, key).Marshal(max)
+		if err != nil {
+			log.Printf("[admin-trace] marshal: %v", err)
+			return nil
+		}
+		return raw
+	}
+
 	// node/node.go (inside NewNode after n.Svc is created)
 	n.Svc.OnDumpRT = func() []byte {
 		var all []Contact
@@ -180,7 +224,7 @@ func NewNode(bind string, adv string, ttl time.Duration, refreshEvery time.Durat
 	// when we learn another nodes id (from ping i guess?) we update our routing table. done here initially
 	n.Svc.OnSeen = func(addr string, peerID [20]byte) {
 		if !isZero(peerID) {
-			n.RoutingTable.Update(Contact{ID: peerID, Addr: addr})
+			n.RoutingTable.Touch(Contact{ID: peerID, Addr: addr})
 		}
 	}
 
@@ -200,26 +244,56 @@ func NewNode(bind string, adv string, ttl time.Duration, refreshEvery time.Durat
 		return MarshalContactList(out)
 	}
 
-	n.Svc.OnStore = func(key [20]byte, val []byte) {
-		n.mu.Lock()
-		n.Store[string(key[:])] = Value{
-			Data:      append([]byte(nil), val...),
-			ExpiresAt: time.Now().Add(n.ttl),
+	n.Svc.OnStore = func(key [20]byte, val []byte, ttl, expiresIn time.Duration) error {
+		if SHA1ID(val) != key {
+			return ErrKeyMismatch
 		}
-		n.mu.Unlock()
-		log.Printf("[node] STORED key=%x len=%d at %s", key[:], len(val), n.Svc.Addr())
+		ttl = n.valueTTL(ttl)
+		life := n.replicaTTL(key, ttl)
+		if expiresIn > 0 && expiresIn < life {
+			life = expiresIn // a republished replica does not outlive the copy it was made from
+		}
+		n.mu.Lock() // check and put in one go
+		defer n.mu.Unlock()
+		if v, ok := n.Store.Get(key); ok && v.Origin {
+			return nil // our own value coming back from a replica, it stays ours
+		}
+		// LastPublish is when we last received it, a replica stored here within Republish is not
+		// republished by us
+		now := time.Now()
+		if err := n.Store.Put(key, Value{Data: val, LastPublish: now, ExpiresAt: now.Add(life), TTL: ttl}); err != nil {
+			return err
+		}
+		log.Printf("[node] STORED key=%x len=%d ttl=%v at %s", key[:], len(val), life, n.Svc.Addr())
+		return nil
+	}
+
+	// a CACHE from someone's lookup. never replaces a real replica, and lives at most n.ttl
+	n.Svc.OnCache = func(key [20]byte, val []byte, ttl time.Duration) error {
+		if SHA1ID(val) != key {
+			return ErrKeyMismatch
+		}
+		if ttl > n.ttl {
+			ttl = n.ttl
+		}
+		n.mu.Lock() // check and put in one go
+		defer n.mu.Unlock()
+		if v, ok := n.Store.Get(key); ok && !v.Cached {
+			return nil
+		}
+		if err := n.Store.Put(key, Value{Data: val, Cached: true, ExpiresAt: time.Now().Add(ttl)}); err != nil {
+			return err
+		}
+		log.Printf("[node] CACHED key=%x len=%d ttl=%v at %s", key[:], len(val), ttl, n.Svc.Addr())
+		return nil
 	}
 
 	n.Svc.OnFindValue = func(key [20]byte) ([]byte, []byte) {
-		n.mu.RLock()
-		v, ok := n.Store[string(key[:])]
-		n.mu.RUnlock()
-		if ok {
-			n.mu.Lock()
-			v.ExpiresAt = time.Now().Add(n.ttl)
-			n.Store[string(key[:])] = v
-			n.mu.Unlock()
-			return append([]byte(nil), v.Data...), nil
+		if v, ok := n.Store.Get(key); ok {
+			if !v.Cached && !v.Origin { // cached copies keep their short ttl, our own values the publisher's
+				_, _ = n.Store.Touch(key, time.Now().Add(n.replicaTTL(key, v.TTL)))
+			}
+			return append([]byte{}, v.Data...), nil // non-nil, an empty value is still a value
 		}
 		cs := n.RoutingTable.Closest(key, K)
 		return nil, MarshalContactList(cs)
@@ -232,45 +306,211 @@ func (n *Node) startRepublisher() {
 	tick := time.NewTicker(n.refreshEvery)
 	go func() {
 		for range tick.C {
-			now := time.Now()
-			var keys [][20]byte
-			n.mu.RLock()
-			for kStr, v := range n.Store {
-				if !v.Origin {
-					continue
+			n.republishOrigins(time.Now())
+		}
+	}()
+}
+
+// one pass of the origin republisher: every value we published that is due gets a fresh lookup for
+// the current K closest nodes. each of them is sent a REFRESH, and the ones that answer they do not
+// hold the value (restarted, or new to the neighbourhood) get a full STORE
+func (n *Node) republishOrigins(now time.Time) {
+	var keys [][20]byte
+	_ = n.Store.Iterate(func(key [20]byte, v Value) bool {
+		if v.Origin && (v.LastPublish.IsZero() || now.Sub(v.LastPublish) >= n.refreshEvery) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	for _, key := range keys {
+		v, ok := n.Store.Get(key)
+		if !ok {
+			continue
+		}
+		var left time.Duration // a restored replica lives as long as our value, not a fresh ttl
+		if !v.ExpiresAt.IsZero() {
+			if left = v.ExpiresAt.Sub(now); left < time.Second {
+				continue // about to expire anyway
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), n.LookupTimeout(key))
+		cs, _ := n.LookupNode(ctx, key)
+		cancel()
+
+		var wg sync.WaitGroup
+		for _, c := range cs {
+			if c.ID == n.NodeID {
+				continue
+			}
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), n.Svc.RTO(addr))
+				held, err := n.Svc.Refresh(ctx, addr, key)
+				cancel()
+				if err != nil || held {
+					return
 				}
-				if v.LastPublish.IsZero() || now.Sub(v.LastPublish) >= n.refreshEvery {
-					var key [20]byte
-					copy(key[:], []byte(kStr)[:20])
-					keys = append(keys, key)
+				ctx, cancel = context.WithTimeout(context.Background(), n.Svc.RTO(addr))
+				defer cancel()
+				if err := n.Svc.StoreReplica(ctx, addr, key, v.Data, v.TTL, left); err != nil {
+					log.Printf("[node] republish key=%x to %s: %v", key[:4], addr, err)
 				}
+			}(c.Addr)
+		}
+		wg.Wait()
+
+		n.mu.Lock()
+		if v, ok := n.Store.Get(key); ok {
+			v.LastPublish = now
+			_ = n.Store.Put(key, v)
+		}
+		n.mu.Unlock()
+	}
+}
+
+// Stores every replica we hold again at the K closest nodes once an interval (paper, section 2.5), so
+// values outlive the nodes that held them, origin or not
+func (n *Node) startReplicaRepublisher() {
+	if n.Republish <= 0 {
+		return
+	}
+	every := n.Republish / 4
+	if every < time.Second {
+		every = time.Second
+	}
+	tick := time.NewTicker(every)
+	go func() {
+		for range tick.C {
+			n.republishReplicas(time.Now())
+		}
+	}()
+}
+
+// one pass of the replica republisher: every replica (not origin values, they have their own
+// republisher, nor cached copies) that we neither received nor republished within Republish is
+// looked up and stored at the K closest nodes for the rest of its lifetime. those then count it as
+// just received, so usually only one holder republishes a value per interval
+func (n *Node) republishReplicas(now time.Time) {
+	var keys [][20]byte
+	_ = n.Store.Iterate(func(key [20]byte, v Value) bool {
+		if !v.Origin && !v.Cached && now.Sub(v.LastPublish) >= n.Republish {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	for _, key := range keys {
+		v, ok := n.Store.Get(key)
+		if !ok {
+			continue
+		}
+		var left time.Duration // the copies we hand on expire with ours, but keep the publisher's ttl
+		if !v.ExpiresAt.IsZero() {
+			if left = v.ExpiresAt.Sub(now); left < time.Second {
+				continue // about to expire anyway
 			}
-			n.mu.RUnlock()
-
-			for _, key := range keys {
-				cs := n.RoutingTable.Closest(key, K)
-				var wg sync.WaitGroup
-				for _, c := range cs {
-					wg.Add(1)
-					go func(addr string, key [20]byte) {
-						defer wg.Done()
-						ctx, cancel := context.WithTimeout(context.Background(), 800*time.Millisecond)
-						_ = n.Svc.Refresh(ctx, addr, key)
-						cancel()
-					}(c.Addr, key)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.LookupTimeout(key))
+		cs, _ := n.LookupNode(ctx, key)
+		cancel()
+		var wg sync.WaitGroup
+		for _, c := range cs {
+			if c.ID == n.NodeID {
+				continue
+			}
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), n.Svc.RTO(addr))
+				defer cancel()
+				if err := n.Svc.StoreReplica(ctx, addr, key, v.Data, v.TTL, left); err != nil {
+					log.Printf("[node] republish key=%x to %s: %v", key[:4], addr, err)
 				}
-				wg.Wait()
+			}(c.Addr)
+		}
+		wg.Wait()
 
-				n.mu.Lock()
-				v := n.Store[string(key[:])]
-				v.LastPublish = now
-				n.Store[string(key[:])] = v
-				n.mu.Unlock()
+		n.mu.Lock()
+		if v, ok := n.Store.Get(key); ok && !v.Origin {
+			v.LastPublish = now
+			_ = n.Store.Put(key, v)
+		}
+		n.mu.Unlock()
+	}
+}
+
+// Looks up a random id inside every bucket that has not been touched within BucketRefresh
+func (n *Node) startBucketRefresher() {
+	if n.BucketRefresh <= 0 {
+		return
+	}
+	// tick a few times per interval so a bucket never stays stale for much longer than BucketRefresh
+	every := n.BucketRefresh / 4
+	if every < time.Second {
+		every = time.Second
+	}
+	tick := time.NewTicker(every)
+	go func() {
+		for range tick.C {
+			for _, r := range n.RoutingTable.StaleBuckets(time.Now().Add(-n.BucketRefresh)) {
+				target := RandomIDInRange(r[0], r[1])
+				ctx, cancel := context.WithTimeout(context.Background(), n.LookupTimeout(target))
+				_, _ = n.LookupNode(ctx, target)
+				cancel()
 			}
 		}
 	}()
 }
 
+// the ttl a value asked to live for ttl gets here: our default for 0, at most MaxTTL
+func (n *Node) valueTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = n.ttl
+	}
+	if n.MaxTTL > 0 && ttl > n.MaxTTL {
+		ttl = n.MaxTTL
+	}
+	return ttl
+}
+
+// how long we keep a replica of key that asked to live for ttl. as long as we are one of the K
+// closest nodes to key we know of it gets the full valueTTL, past that it is halved for every node
+// closer to key than us, so copies stored far from the key (stale routing, republishing to the
+// wrong nodes) expire quickly (paper, section 2.5)
+func (n *Node) replicaTTL(key [20]byte, ttl time.Duration) time.Duration {
+	ttl = n.valueTTL(ttl)
+	closer := n.RoutingTable.CountCloser(key, n.NodeID, K+30)
+	if closer < K {
+		return ttl
+	}
+	return halveTTL(ttl, closer-K+1)
+}
+
+// timeout for one rpc to c, derived from the round trips we measured to it (see service.Service.RTO)
+func (n *Node) rpcTimeout(c Contact) time.Duration {
+	return n.Svc.RTO(c.Addr)
+}
+
+// how many rpc timeouts in a row a whole lookup gets, see LookupTimeout
+const lookupRounds = 4
+
+// LookupTimeout is the deadline for a whole lookup of target: lookupRounds rpc timeouts of the
+// slowest of the K closest contacts it starts from, so it follows the round trips we measured
+// instead of a fixed guess. with no contacts it is based on the rto of a peer we have no sample of
+func (n *Node) LookupTimeout(target [20]byte) time.Duration {
+	var rto time.Duration
+	for _, c := range n.RoutingTable.Closest(target, K) {
+		rto = max(rto, n.rpcTimeout(c))
+	}
+	if rto == 0 {
+		rto = n.Svc.RTO("")
+	}
+	return lookupRounds * rto
+}
+
 // Returns the adress thats being advertised to other nodes
 func (n *Node) AdvertisedAddr() string {
 	if n.Svc.SelfAddr != "" {
@@ -281,7 +521,7 @@ func (n *Node) AdvertisedAddr() string {
 
 // Finds the given node ID
 func (n *Node) FindNode(to string, target [20]byte) ([]Contact, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), n.Svc.RTO(to))
 	defer cancel()
 	payload, err := n.Svc.FindNode(ctx, to, target)
 	if err != nil {
@@ -296,34 +536,98 @@ func (n *Node) Start() {
 	gc := time.NewTicker(1 * time.Minute)
 	go func() {
 		for range gc.C {
-			now := time.Now()
-			n.mu.Lock()
-			for k, v := range n.Store {
-				if !v.ExpiresAt.IsZero() && now.After(v.ExpiresAt) {
-					delete(n.Store, k)
-				}
+			if _, err := n.Store.Expire(time.Now()); err != nil {
+				log.Printf("[node] expire: %v", err)
 			}
-			n.mu.Unlock()
 		}
 	}()
 
 	// Republisher ticker (U2)
 	n.startRepublisher()
+	n.startReplicaRepublisher()
+
+	// Bucket refresh ticker
+	n.startBucketRefresher()
 
 	n.Svc.Start()
-	go n.bootstrap()
+	go func() {
+		n.restoreState()
+		n.bootstrap()
+	}()
+
+	// Routing table snapshots
+	n.startStateSaver()
+}
+
+// Reloads the routing table snapshot from StateFile. Saved contacts are pinged first and only
+// the ones that answer are put back in the routing table
+func (n *Node) restoreState() {
+	if n.StateFile == "" {
+		return
+	}
+	saved, err := n.RoutingTable.LoadState(n.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[node] could not load state %s: %v", n.StateFile, err)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	var alive atomic.Int32
+	for _, c := range saved {
+		if c.ID == n.NodeID {
+			continue
+		}
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), n.rpcTimeout(c))
+			defer cancel()
+			if err := n.Svc.Ping(ctx, c.Addr); err == nil {
+				n.RoutingTable.Touch(c)
+				alive.Add(1)
+			}
+		}(c)
+	}
+	wg.Wait()
+	log.Printf("[node] restored %d/%d contacts from %s", alive.Load(), len(saved), n.StateFile)
+}
+
+// Saves the routing table to StateFile every StateEvery
+func (n *Node) startStateSaver() {
+	if n.StateFile == "" || n.StateEvery <= 0 {
+		return
+	}
+	tick := time.NewTicker(n.StateEvery)
+	go func() {
+		for range tick.C {
+			if err := n.RoutingTable.SaveState(n.StateFile); err != nil {
+				log.Printf("[node] could not save state %s: %v", n.StateFile, err)
+			}
+		}
+	}()
 }
 
 // Bootstraps the node and populates its routing table
 func (n *Node) bootstrap() {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), n.LookupTimeout(n.NodeID))
 	defer cancel()
 	_, _ = n.LookupNode(ctx, n.NodeID)
 }
 
-// Closes the node and its service
+// Closes the node and its service, saving the routing table one last time if StateFile is set
 func (n *Node) Close() error {
-	return n.Svc.Close()
+	if n.StateFile != "" {
+		if err := n.RoutingTable.SaveState(n.StateFile); err != nil {
+			log.Printf("[node] could not save state %s: %v", n.StateFile, err)
+		}
+	}
+	err := n.Svc.Close()
+	if serr := n.Store.Close(); err == nil {
+		err = serr
+	}
+	return err
 }
 
 // Checks if a NodeID is all zeroes
@@ -0,0 +1,254 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// objects bigger than one value are split into chunks of at most ChunkSize bytes, each stored under
+// its own SHA-1 like any other value. a manifest lists the keys of the chunks (or, for really big
+// objects, of further manifests) and the key of the top manifest is the key of the whole object.
+//
+// manifest: magic(8) + object size(8) + n * (kind(1) + key(20))
+
+const (
+	ChunkSize     = 16 << 10 // well below service.MaxValueSize, a chunk is lost with any of its fragments
+	MaxObjectSize = 64 << 20
+
+	objectParallel = 8 // chunk puts/gets in flight at once
+)
+
+var manifestMagic = []byte("KADOBJ1\n")
+
+const (
+	manifestHeader    = 8 + 8
+	manifestEntrySize = 1 + 20
+	manifestFanout    = (ChunkSize - manifestHeader) / manifestEntrySize
+
+	entryChunk    byte = 0
+	entryManifest byte = 1
+)
+
+var ErrObjectTooLarge = fmt.Errorf("object too large (max %d bytes)", MaxObjectSize)
+
+// stores one value and returns its key, e.g. Service.AdminPut against a running node
+type PutFunc func(ctx context.Context, value []byte) ([20]byte, error)
+
+// fetches one value by its key, e.g. Service.AdminGet against a running node
+type GetFunc func(ctx context.Context, key [20]byte) ([]byte, error)
+
+type manifestEntry struct {
+	kind byte
+	key  [20]byte
+}
+
+// IsManifest reports whether v is an object manifest rather than a plain value
+func IsManifest(v []byte) bool {
+	return len(v) >= manifestHeader && bytes.HasPrefix(v, manifestMagic) && (len(v)-manifestHeader)%manifestEntrySize == 0
+}
+
+func encodeManifest(size uint64, entries []manifestEntry) []byte {
+	out := make([]byte, 0, manifestHeader+len(entries)*manifestEntrySize)
+	out = append(out, manifestMagic...)
+	out = binary.BigEndian.AppendUint64(out, size)
+	for _, e := range entries {
+		out = append(out, e.kind)
+		out = append(out, e.key[:]...)
+	}
+	return out
+}
+
+func decodeManifest(v []byte) (uint64, []manifestEntry, error) {
+	if !IsManifest(v) {
+		return 0, nil, errors.New("bad manifest")
+	}
+	size := binary.BigEndian.Uint64(v[len(manifestMagic):manifestHeader])
+	if size > MaxObjectSize {
+		return 0, nil, ErrObjectTooLarge
+	}
+	var entries []manifestEntry
+	for b := v[manifestHeader:]; len(b) > 0; b = b[manifestEntrySize:] {
+		e := manifestEntry{kind: b[0]}
+		copy(e.key[:], b[1:manifestEntrySize])
+		entries = append(entries, e)
+	}
+	return size, entries, nil
+}
+
+// PutObject stores data of any size up to MaxObjectSize and returns the key to get it back with.
+// small values are stored as they are, anything else as chunks plus manifests
+func PutObject(ctx context.Context, data []byte, put PutFunc) ([20]byte, error) {
+	if len(data) > MaxObjectSize {
+		return [20]byte{}, ErrObjectTooLarge
+	}
+	// a small value that happens to look like a manifest still gets one, so get can tell them apart
+	if len(data) <= ChunkSize && !bytes.HasPrefix(data, manifestMagic) {
+		return putVerified(ctx, data, put)
+	}
+
+	var pieces [][]byte
+	var sizes []uint64
+	for off := 0; off < len(data); off += ChunkSize {
+		end := min(off+ChunkSize, len(data))
+		pieces = append(pieces, data[off:end])
+		sizes = append(sizes, uint64(end-off))
+	}
+	kind := entryChunk
+	for {
+		keys, err := putAll(ctx, pieces, put)
+		if err != nil {
+			return [20]byte{}, err
+		}
+		entries := make([]manifestEntry, len(keys))
+		for i, k := range keys {
+			entries[i] = manifestEntry{kind: kind, key: k}
+		}
+		if len(entries) <= manifestFanout {
+			return putVerified(ctx, encodeManifest(uint64(len(data)), entries), put)
+		}
+
+		// too many keys for one manifest, group them into manifests and go one level up
+		var next [][]byte
+		var nextSizes []uint64
+		for i := 0; i < len(entries); i += manifestFanout {
+			j := min(i+manifestFanout, len(entries))
+			var sum uint64
+			for _, s := range sizes[i:j] {
+				sum += s
+			}
+			next = append(next, encodeManifest(sum, entries[i:j]))
+			nextSizes = append(nextSizes, sum)
+		}
+		pieces, sizes, kind = next, nextSizes, entryManifest
+	}
+}
+
+// stores v and checks that the key we got back really is its hash
+func putVerified(ctx context.Context, v []byte, put PutFunc) ([20]byte, error) {
+	key, err := put(ctx, v)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	if key != SHA1ID(v) {
+		return [20]byte{}, fmt.Errorf("stored under %x, expected %x", key[:4], SHA1ID(v))
+	}
+	return key, nil
+}
+
+// stores every piece, objectParallel at a time. the keys come back in the same order
+func putAll(ctx context.Context, pieces [][]byte, put PutFunc) ([][20]byte, error) {
+	keys := make([][20]byte, len(pieces))
+	err := parallel(ctx, len(pieces), func(ctx context.Context, i int) error {
+		k, err := putVerified(ctx, pieces[i], put)
+		keys[i] = k
+		return err
+	})
+	return keys, err
+}
+
+// GetObject fetches the object stored under key by PutObject, following its manifests and checking
+// the hash of every piece
+func GetObject(ctx context.Context, key [20]byte, get GetFunc) ([]byte, error) {
+	v, err := getVerified(ctx, key, get)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(v, manifestMagic) {
+		return v, nil
+	}
+	size, entries, err := decodeManifest(v)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, size)
+	if out, err = resolveManifest(ctx, out, entries, get); err != nil {
+		return nil, err
+	}
+	if uint64(len(out)) != size {
+		return nil, fmt.Errorf("object %x is %d bytes, manifest says %d", key[:4], len(out), size)
+	}
+	return out, nil
+}
+
+// fetches the entries of a manifest in parallel and appends their data to out, depth first
+func resolveManifest(ctx context.Context, out []byte, entries []manifestEntry, get GetFunc) ([]byte, error) {
+	vals := make([][]byte, len(entries))
+	err := parallel(ctx, len(entries), func(ctx context.Context, i int) error {
+		v, err := getVerified(ctx, entries[i].key, get)
+		vals[i] = v
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		switch e.kind {
+		case entryChunk:
+			out = append(out, vals[i]...)
+		case entryManifest:
+			_, sub, err := decodeManifest(vals[i])
+			if err != nil {
+				return nil, err
+			}
+			if out, err = resolveManifest(ctx, out, sub, get); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("bad manifest entry kind %d", e.kind)
+		}
+		if len(out) > MaxObjectSize {
+			return nil, ErrObjectTooLarge
+		}
+	}
+	return out, nil
+}
+
+// fetches key and checks that what we got hashes to it
+func getVerified(ctx context.Context, key [20]byte, get GetFunc) ([]byte, error) {
+	v, err := get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("get %x: %w", key[:4], err)
+	}
+	if SHA1ID(v) != key {
+		return nil, fmt.Errorf("get %x: value does not match its key", key[:4])
+	}
+	return v, nil
+}
+
+// runs f for 0..n-1, objectParallel at a time, and returns the first error. the ctx handed to f is
+// cancelled once anything fails
+func parallel(ctx context.Context, n int, f func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sem := make(chan struct{}, objectParallel)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := 0; i < n; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := f(ctx, i); err != nil {
+				once.Do(func() { firstErr = err; cancel() })
+			}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
@@ -0,0 +1,91 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// in-memory value store standing in for a running node
+type memValues struct {
+	mu   sync.Mutex
+	vals map[[20]byte][]byte
+}
+
+func newMemValues() *memValues { return &memValues{vals: make(map[[20]byte][]byte)} }
+
+func (m *memValues) put(ctx context.Context, v []byte) ([20]byte, error) {
+	key := SHA1ID(v)
+	m.mu.Lock()
+	m.vals[key] = append([]byte{}, v...)
+	m.mu.Unlock()
+	return key, nil
+}
+
+func (m *memValues) get(ctx context.Context, key [20]byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.vals[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return v, nil
+}
+
+func TestObject_RoundTrip(t *testing.T) {
+	// one plain value, one manifest of chunks, and one with a second level of manifests
+	for _, size := range []int{100, 10 * ChunkSize, (manifestFanout + 3) * ChunkSize} {
+		m := newMemValues()
+		data := make([]byte, size)
+		_, _ = rand.Read(data)
+
+		key, err := PutObject(context.Background(), data, m.put)
+		if err != nil {
+			t.Fatalf("size %d: put failed: %v", size, err)
+		}
+		got, err := GetObject(context.Background(), key, m.get)
+		if err != nil {
+			t.Fatalf("size %d: get failed: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: got %d different bytes back", size, len(got))
+		}
+		if size <= ChunkSize && key != SHA1ID(data) {
+			t.Fatalf("small value should be stored as is")
+		}
+	}
+}
+
+func TestObject_SmallValueLookingLikeManifest(t *testing.T) {
+	m := newMemValues()
+	data := encodeManifest(0, nil)
+	key, err := PutObject(context.Background(), data, m.put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key == SHA1ID(data) {
+		t.Fatal("a value that looks like a manifest must be wrapped in a real one")
+	}
+	if got, err := GetObject(context.Background(), key, m.get); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %q %v", got, err)
+	}
+}
+
+func TestObject_TamperedChunkIsRejected(t *testing.T) {
+	m := newMemValues()
+	data := make([]byte, 3*ChunkSize)
+	_, _ = rand.Read(data)
+	key, err := PutObject(context.Background(), data, m.put)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := SHA1ID(data[ChunkSize : 2*ChunkSize])
+	m.vals[chunk] = []byte("not the chunk")
+	if _, err := GetObject(context.Background(), key, m.get); err == nil {
+		t.Fatal("a chunk that does not hash to its key should fail the get")
+	}
+}
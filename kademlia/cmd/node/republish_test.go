@@ -0,0 +1,105 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// n nodes that all know each other
+func startMesh(t *testing.T, n int) []*Node {
+	nodes := startNodes(t, n)
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b {
+				a.RoutingTable.Update(Contact{ID: b.NodeID, Addr: b.Svc.Addr()})
+			}
+		}
+	}
+	return nodes
+}
+
+func TestRepublishReplicas_StoresAtTheKClosest(t *testing.T) {
+	nodes := startMesh(t, 3)
+	a, b, c := nodes[0], nodes[1], nodes[2]
+
+	data := []byte("replica")
+	key := SHA1ID(data)
+	exp := time.Now().Add(5 * time.Second)
+	_ = a.Store.Put(key, Value{Data: data, ExpiresAt: exp, TTL: 8 * time.Second}) // received long ago
+
+	a.republishReplicas(time.Now())
+	for _, n := range []*Node{b, c} {
+		v, ok := n.Store.Get(key)
+		if !ok {
+			t.Fatalf("%s did not get the replica", n.Svc.Addr())
+		}
+		// the rest of its lifetime, not a fresh ttl
+		if v.ExpiresAt.After(exp.Add(time.Second)) || v.Origin || v.Cached {
+			t.Fatalf("bad republished copy: %+v", v)
+		}
+		// but the publisher's ttl, so the copies made from it do not decay
+		if v.TTL != 8*time.Second {
+			t.Fatalf("republished copy has ttl %v, the publisher asked for %v", v.TTL, 8*time.Second)
+		}
+	}
+	if v, _ := a.Store.Get(key); time.Since(v.LastPublish) > time.Second {
+		t.Fatal("republishing should stamp LastPublish")
+	}
+
+	// b just received it, so it leaves the republishing to others this interval
+	_, _ = c.Store.Delete(key)
+	b.republishReplicas(time.Now())
+	if _, ok := c.Store.Get(key); ok {
+		t.Fatal("a replica received within the interval should not be republished")
+	}
+}
+
+func TestStore_DoesNotTakeOverOriginValue(t *testing.T) {
+	nodes := startMesh(t, 2)
+	a, b := nodes[0], nodes[1]
+
+	data := []byte("mine")
+	key := SHA1ID(data)
+	_ = a.Store.Put(key, Value{Data: data, Origin: true})
+	_ = b.Store.Put(key, Value{Data: data, ExpiresAt: time.Now().Add(time.Minute)})
+
+	b.republishReplicas(time.Now())
+	if v, ok := a.Store.Get(key); !ok || !v.Origin {
+		t.Fatal("a STORE of our own value must not turn it into a replica")
+	}
+}
+
+func TestRepublishOrigins_RestoresMissingReplicas(t *testing.T) {
+	nodes := startMesh(t, 3)
+	a, b, c := nodes[0], nodes[1], nodes[2]
+
+	data := []byte("published")
+	key := SHA1ID(data)
+	exp := time.Now().Add(7 * time.Second)
+	_ = a.Store.Put(key, Value{Data: data, Origin: true, TTL: 8 * time.Second, ExpiresAt: exp})
+	// b still has its replica, c lost it on a restart and only has a cached copy from a lookup
+	_ = b.Store.Put(key, Value{Data: data, ExpiresAt: time.Now().Add(time.Second), TTL: time.Minute})
+	_ = c.Store.Put(key, Value{Data: data, Cached: true, ExpiresAt: time.Now().Add(time.Second)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if held, err := a.Svc.Refresh(ctx, c.Svc.Addr(), SHA1ID([]byte("nothing"))); err != nil || held {
+		t.Fatalf("refresh of a key c does not hold: held=%v err=%v", held, err)
+	}
+
+	a.republishOrigins(time.Now())
+	if v, _ := b.Store.Get(key); time.Until(v.ExpiresAt) < 5*time.Second {
+		t.Fatalf("b's replica should have been refreshed, expires in %v", time.Until(v.ExpiresAt))
+	}
+	if v, ok := c.Store.Get(key); !ok || v.Cached || time.Until(v.ExpiresAt) < 5*time.Second {
+		t.Fatalf("c should have been sent a full STORE, has %+v", v)
+	}
+	// with the publisher's ttl, but no longer than the origin value itself lives
+	if v, _ := c.Store.Get(key); v.TTL != 8*time.Second || v.ExpiresAt.After(exp.Add(time.Second)) {
+		t.Fatalf("restored replica should keep the ttl and expire with the origin value, has %+v", v)
+	}
+	if v, _ := a.Store.Get(key); !v.Origin || time.Since(v.LastPublish) > time.Second {
+		t.Fatal("republishing should stamp LastPublish on the origin value")
+	}
+}
@@ -5,26 +5,40 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 )
 
 type RoutingTable struct {
 	SelfID     [20]byte
 	BucketList []*Kbucket
 	mu         sync.RWMutex
+
+	// Ping checks if a contact is still alive, used before evicting the head of a full bucket.
+	// If nil, full buckets keep their old contacts and newcomers only go to the replacement cache.
+	Ping    func(c Contact) bool
+	pinging map[[20]byte]bool // heads with a ping in flight, so we dont ping them twice
+
+	// contacts are evicted (and replaced from the replacement cache) after this many failed RPCs in a row
+	MaxFailures int
 }
 
+const DefaultMaxFailures = 3
+
 // Creates a new routing table with a single kbucket that is covering the entire id space
-func NewRoutingTable(SelfId, lower, upper [20]byte) (RoutingTable, error) {
+func NewRoutingTable(SelfId, lower, upper [20]byte) (*RoutingTable, error) {
 	const KBucketCapacity = 20
 
-	rt := RoutingTable{
+	rt := &RoutingTable{
 		SelfID:     SelfId,
 		BucketList: make([]*Kbucket, 1),
+		pinging:    make(map[[20]byte]bool),
+
+		MaxFailures: DefaultMaxFailures,
 	}
 
 	kb, err := NewKBucket(KBucketCapacity, lower, upper, nil)
 	if err != nil {
-		return RoutingTable{}, errors.New("failed to create initial kbucket")
+		return nil, errors.New("failed to create initial kbucket")
 	}
 
 	rt.BucketList[0] = &kb
@@ -87,15 +101,144 @@ func (rt *RoutingTable) removeBucketLocked(kb *Kbucket) error {
 	return nil
 }
 
-// call everytime we succeed with RPC. if contact exist, move to tail. if bucket has room, append. bucket full? drop it or remove head. add LRU logic perhaps?
+// call everytime we succeed with RPC. if contact exist, move to tail. if bucket has room, append.
+// bucket full? split it if we are allowed to (see canSplitLocked), otherwise park the newcomer in the
+// replacement cache and ping the head, it is only evicted if the ping fails
 func (rt *RoutingTable) Update(c Contact) {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
-	i := rt.bucketIndexFor(c.ID)
+	if c.ID == rt.SelfID {
+		return
+	}
+
+	var kb *Kbucket
+	for {
+		i := rt.bucketIndexFor(c.ID)
+		if i < 0 {
+			return
+		}
+		kb = rt.BucketList[i]
+		if !kb.isFullFor(c) || !rt.canSplitLocked(kb, c) {
+			break
+		}
+		if err := rt.splitBucketLocked(kb); err != nil {
+			break // kb is left as it was, c takes the replacement cache and ping path below
+		}
+	}
+
+	head, full := kb.Upsert(c)
+	if !full || rt.Ping == nil || rt.pinging[head.ID] {
+		return
+	}
+	if rt.pinging == nil {
+		rt.pinging = make(map[[20]byte]bool)
+	}
+	rt.pinging[head.ID] = true
+
+	// ping async, Update is called from the packet handler so we cant block waiting for the PONG here
+	go rt.pingHead(head)
+}
+
+// call when an RPC with c succeeded, stamps LastSeen and then updates like normal
+func (rt *RoutingTable) Touch(c Contact) {
+	c.Touch()
+	rt.Update(c)
+}
+
+// call when an RPC to addr failed (timeout or network error). the contact is evicted once it reaches MaxFailures
+func (rt *RoutingTable) RecordFailure(addr string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, b := range rt.BucketList {
+		b.mu.Lock()
+		c, fails, ok := b.recordFailureLocked(addr)
+		b.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if rt.MaxFailures > 0 && fails >= rt.MaxFailures {
+			b.EvictAndReplace(c)
+		}
+		return
+	}
+}
+
+// call when an RPC to addr succeeded (any reply counts, not only PONG): resets its failure counter,
+// stamps LastSeen and moves it to the tail of its bucket like Update does
+func (rt *RoutingTable) RecordSuccess(addr string) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for _, b := range rt.BucketList {
+		b.mu.Lock()
+		ok := b.recordSuccessLocked(addr)
+		b.mu.Unlock()
+		if ok {
+			return
+		}
+	}
+}
+
+// Returns the [lower, upper] ranges of buckets not touched since the cutoff and marks them as refreshed,
+// so the caller can do a lookup for a random id inside each of them
+func (rt *RoutingTable) StaleBuckets(cutoff time.Time) [][2][20]byte {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	var out [][2][20]byte
+	now := time.Now()
+	for _, b := range rt.BucketList {
+		if b.LastTouched().After(cutoff) {
+			continue
+		}
+		b.mu.Lock()
+		b.RefreshedAt = now
+		b.mu.Unlock()
+		out = append(out, [2][20]byte{b.LowerLimit, b.UpperLimit})
+	}
+	return out
+}
+
+// pings the head of a full bucket. alive heads are moved to the tail, dead ones are replaced from the cache
+func (rt *RoutingTable) pingHead(head Contact) {
+	alive := rt.Ping(head)
+	if alive {
+		head.Touch()
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	delete(rt.pinging, head.ID)
+
+	i := rt.bucketIndexFor(head.ID)
 	if i < 0 {
 		return
 	}
-	rt.BucketList[i].Upsert(c)
+	kb := rt.BucketList[i]
+	if alive {
+		kb.mu.Lock()
+		kb.moveToTailIfExist(head)
+		kb.mu.Unlock()
+		return
+	}
+	kb.EvictAndReplace(head)
+}
+
+// A full bucket may be split if its range covers our own ID, or (relaxed rule from the paper, for
+// unbalanced trees) if the newcomer would be among the k closest contacts we know to ourselves.
+func (rt *RoutingTable) canSplitLocked(kb *Kbucket, c Contact) bool {
+	if kb.LowerLimit == kb.UpperLimit {
+		return false // a single id cant be split any further
+	}
+	if compare(rt.SelfID, kb.LowerLimit) >= 0 && compare(rt.SelfID, kb.UpperLimit) <= 0 {
+		return true
+	}
+
+	closest := rt.closestLocked(rt.SelfID, kb.Capacity)
+	if len(closest) < kb.Capacity {
+		return true
+	}
+	kth := xor(rt.SelfID, closest[len(closest)-1].ID)
+	return less160(xor(rt.SelfID, c.ID), kth)
 }
 
 // Splits a bucket into two new buckets
@@ -104,6 +247,14 @@ func (rt *RoutingTable) SplitBucket(originBucket *Kbucket) error {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
 
+	return rt.splitBucketLocked(originBucket)
+}
+
+// splits a bucket, caller must hold rt.mu. on error the table is left as it was
+func (rt *RoutingTable) splitBucketLocked(originBucket *Kbucket) error {
+	originBucket.mu.RLock()
+	defer originBucket.mu.RUnlock()
+
 	mid := midpoint(originBucket.LowerLimit, originBucket.UpperLimit)
 
 	kb1Lower := originBucket.LowerLimit
@@ -122,12 +273,35 @@ func (rt *RoutingTable) SplitBucket(originBucket *Kbucket) error {
 
 	kb1, _ := NewKBucket(originBucket.Capacity, kb1Lower, kb1Upper, kb1Contacts) // Bucket1 = [originbucket.lower, mid]
 	kb2, _ := NewKBucket(originBucket.Capacity, kb2Lower, kb2Upper, kb2Contacts) // Bucket2 = [mid + 1, originbucket.upper]
+	kb1.ReplacementCap = originBucket.ReplacementCap
+	kb2.ReplacementCap = originBucket.ReplacementCap
+
+	// replacements follow their range too, and may fill up the room the split just made
+	for _, c := range originBucket.Replacements {
+		target := &kb2
+		if compare(c.ID, kb1Upper) <= 0 {
+			target = &kb1
+		}
+		if len(target.Contacts) < target.Capacity {
+			target.Contacts = append(target.Contacts, c)
+		} else {
+			target.Replacements = append(target.Replacements, c)
+		}
+	}
 
-	rt.removeBucketLocked(originBucket)
-
-	rt.addBucketLocked(&kb1)
-	rt.addBucketLocked(&kb2)
+	if err := rt.removeBucketLocked(originBucket); err != nil {
+		return err
+	}
 
+	if err := rt.addBucketLocked(&kb1); err != nil {
+		_ = rt.addBucketLocked(originBucket)
+		return err
+	}
+	if err := rt.addBucketLocked(&kb2); err != nil {
+		_ = rt.removeBucketLocked(&kb1)
+		_ = rt.addBucketLocked(originBucket)
+		return err
+	}
 	return nil
 }
 
@@ -156,16 +330,30 @@ func addOne(x [20]byte) [20]byte { // addOne returns x+1 (mod 2^160)
 }
 
 func midpoint(a, b [20]byte) [20]byte { // midpoint returns floor((a+b)/2)
-	var out [20]byte
+	// add from the least significant byte, keeping the final carry as bit 160
+	var sum [20]byte
 	var carry uint16
 	for i := 19; i >= 0; i-- {
-		sum := uint16(a[i]) + uint16(b[i]) + carry
-		out[i] = byte((sum >> 1) & 0xff) // divide by 2
-		carry = (sum & 1) << 8           // carry remainder to next higher byte
+		s := uint16(a[i]) + uint16(b[i]) + carry
+		sum[i] = byte(s)
+		carry = s >> 8
+	}
+	// then shift right by one from the most significant byte
+	var out [20]byte
+	for i := 0; i < 20; i++ {
+		out[i] = byte(carry<<7) | sum[i]>>1
+		carry = uint16(sum[i] & 1)
 	}
 	return out
 }
 
+// Returns the number of buckets in the routing table
+func (rt *RoutingTable) BucketsLen() int {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return len(rt.BucketList)
+}
+
 func (rt *RoutingTable) bucketIndexFor(id [20]byte) int {
 	for i := range rt.BucketList {
 		b := rt.BucketList[i]
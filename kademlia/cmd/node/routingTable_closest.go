@@ -24,22 +24,69 @@ func less160(a, b [20]byte) bool { // moved it here because it made more sense i
 func (rt *RoutingTable) Closest(target [20]byte, k int) []Contact {
 	rt.mu.RLock()
 	defer rt.mu.RUnlock()
+	return rt.closestLocked(target, k)
+}
+
+// Counts the contacts that are closer to target than id, up to max
+func (rt *RoutingTable) CountCloser(target, id [20]byte, max int) int {
+	d := xor(target, id)
+	n := 0
+	for _, c := range rt.Closest(target, max) {
+		if less160(xor(target, c.ID), d) {
+			n++
+		}
+	}
+	return n
+}
 
+// same as Closest, caller must hold rt.mu.
+// buckets are visited in order of the smallest XOR distance any id in them can have to the target,
+// starting with the bucket the target falls in. once we hold k contacts and the next bucket cant
+// beat the k-th best one we stop, so only a few buckets are ever copied and sorted
+func (rt *RoutingTable) closestLocked(target [20]byte, k int) []Contact {
 	type pair struct {
 		c Contact
 		d [20]byte
 	}
-	tmp := make([]pair, 0, 64)
+	if k <= 0 {
+		return []Contact{}
+	}
+
+	type bucketDist struct {
+		b   *Kbucket
+		min [20]byte
+	}
+	order := make([]bucketDist, len(rt.BucketList))
+	for i, b := range rt.BucketList {
+		order[i] = bucketDist{b: b, min: minDistance(target, b.LowerLimit, b.UpperLimit)}
+	}
+	sort.Slice(order, func(i, j int) bool { return less160(order[i].min, order[j].min) })
 
-	for _, b := range rt.BucketList {
-		b.mu.RLock()
-		for _, c := range b.Contacts {
+	tmp := make([]pair, 0, 2*k)
+	sorted := true
+	for _, bd := range order {
+		if len(tmp) >= k {
+			if !sorted {
+				sort.Slice(tmp, func(i, j int) bool { return less160(tmp[i].d, tmp[j].d) })
+				tmp = tmp[:k]
+				sorted = true
+			}
+			if !less160(bd.min, tmp[k-1].d) {
+				break
+			}
+		}
+
+		bd.b.mu.RLock()
+		for _, c := range bd.b.Contacts {
 			tmp = append(tmp, pair{c: c, d: xor(target, c.ID)})
+			sorted = false
 		}
-		b.mu.RUnlock()
+		bd.b.mu.RUnlock()
 	}
 
-	sort.Slice(tmp, func(i, j int) bool { return less160(tmp[i].d, tmp[j].d) })
+	if !sorted {
+		sort.Slice(tmp, func(i, j int) bool { return less160(tmp[i].d, tmp[j].d) })
+	}
 	if k > len(tmp) {
 		k = len(tmp)
 	}
@@ -49,3 +96,28 @@ func (rt *RoutingTable) Closest(target [20]byte, k int) []Contact {
 	}
 	return out
 }
+
+// lower bound on the XOR distance from target to any id in [lower, upper]: every id in the range
+// shares the common prefix of lower and upper, so the distance can only differ below that prefix
+func minDistance(target, lower, upper [20]byte) [20]byte {
+	d := xor(target, lower)
+	i := 0
+	for i < 20 && lower[i] == upper[i] {
+		i++
+	}
+	if i == 20 {
+		return d
+	}
+	// keep the equal high bits of the first differing byte, clear everything below
+	diff := lower[i] ^ upper[i]
+	mask := byte(0xff)
+	for diff != 0 {
+		diff >>= 1
+		mask <<= 1
+	}
+	d[i] &= mask
+	for j := i + 1; j < 20; j++ {
+		d[j] = 0
+	}
+	return d
+}
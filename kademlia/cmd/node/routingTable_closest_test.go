@@ -0,0 +1,132 @@
+package node
+
+import (
+	"sort"
+	"testing"
+)
+
+// the old Closest: copy every contact and sort them all. kept to check results and to benchmark against
+func closestFullSort(rt *RoutingTable, target [20]byte, k int) []Contact {
+	type pair struct {
+		c Contact
+		d [20]byte
+	}
+	tmp := make([]pair, 0, 64)
+	for _, b := range rt.BucketList {
+		for _, c := range b.Contacts {
+			tmp = append(tmp, pair{c: c, d: xor(target, c.ID)})
+		}
+	}
+	sort.Slice(tmp, func(i, j int) bool { return less160(tmp[i].d, tmp[j].d) })
+	if k > len(tmp) {
+		k = len(tmp)
+	}
+	out := make([]Contact, k)
+	for i := 0; i < k; i++ {
+		out[i] = tmp[i].c
+	}
+	return out
+}
+
+// builds a table of 2^depth equally sized buckets holding n random contacts in total
+func buildLargeTable(tb testing.TB, depth, n int) *RoutingTable {
+	tb.Helper()
+	var lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	rt, _ := NewRoutingTable(RandomNodeID(), lower, upper)
+	for d := 0; d < depth; d++ {
+		for _, b := range append([]*Kbucket(nil), rt.BucketList...) {
+			if err := rt.SplitBucket(b); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	for _, b := range rt.BucketList {
+		b.Capacity = n
+	}
+	for i := 0; i < n; i++ {
+		c := Contact{ID: RandomNodeID(), Addr: "127.0.0.1:1"}
+		rt.BucketList[rt.bucketIndexFor(c.ID)].AddToKBucket(c)
+	}
+	return rt
+}
+
+func TestClosest_MatchesFullSort(t *testing.T) {
+	for _, depth := range []int{0, 1, 4, 8} {
+		rt := buildLargeTable(t, depth, 2000)
+		for i := 0; i < 50; i++ {
+			target := RandomNodeID()
+			if i == 0 {
+				target = rt.SelfID
+			}
+			for _, k := range []int{1, K, 300} {
+				got := rt.Closest(target, k)
+				want := closestFullSort(rt, target, k)
+				if len(got) != len(want) {
+					t.Fatalf("depth=%d k=%d: got %d contacts, want %d", depth, k, len(got), len(want))
+				}
+				for j := range want {
+					if got[j].ID != want[j].ID {
+						t.Fatalf("depth=%d k=%d: mismatch at %d: got %x want %x", depth, k, j, got[j].ID[:4], want[j].ID[:4])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestClosest_UnevenBuckets(t *testing.T) {
+	var self, lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	rt, _ := NewRoutingTable(self, lower, upper)
+	for i := 0; i < 1000; i++ {
+		rt.Update(Contact{ID: RandomNodeID(), Addr: "127.0.0.1:1"})
+	}
+	for i := 0; i < 50; i++ {
+		target := RandomNodeID()
+		got := rt.Closest(target, K)
+		want := closestFullSort(rt, target, K)
+		for j := range want {
+			if got[j].ID != want[j].ID {
+				t.Fatalf("mismatch at %d: got %x want %x", j, got[j].ID[:4], want[j].ID[:4])
+			}
+		}
+	}
+}
+
+func TestMinDistance(t *testing.T) {
+	lower := idWithFirstByte(0x40)
+	upper := upperWithFirstByte(0x7F)
+
+	// target inside the range -> bound is zero
+	if d := minDistance(idWithFirstByte(0x55), lower, upper); d != ([20]byte{}) {
+		t.Fatalf("expected zero bound for a target inside the range, got %x", d)
+	}
+	// target in the other half -> bound is the top differing bit only
+	if d := minDistance(idWithFirstByte(0xC0), lower, upper); d != idWithFirstByte(0x80) {
+		t.Fatalf("expected 80.. bound, got %x", d)
+	}
+}
+
+func benchmarkClosest(b *testing.B, n int, fn func(rt *RoutingTable, target [20]byte, k int) []Contact) {
+	rt := buildLargeTable(b, 9, n)
+	targets := make([][20]byte, 256)
+	for i := range targets {
+		targets[i] = RandomNodeID()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = fn(rt, targets[i%len(targets)], K)
+	}
+}
+
+func bucketAware(rt *RoutingTable, target [20]byte, k int) []Contact { return rt.Closest(target, k) }
+
+func BenchmarkClosest_BucketAware_10k(b *testing.B) { benchmarkClosest(b, 10000, bucketAware) }
+func BenchmarkClosest_FullSort_10k(b *testing.B)    { benchmarkClosest(b, 10000, closestFullSort) }
+func BenchmarkClosest_BucketAware_50k(b *testing.B) { benchmarkClosest(b, 50000, bucketAware) }
+func BenchmarkClosest_FullSort_50k(b *testing.B)    { benchmarkClosest(b, 50000, closestFullSort) }
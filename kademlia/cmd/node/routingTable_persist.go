@@ -0,0 +1,175 @@
+package node
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// on-disk format of the routing table, ids are hex so the file stays readable
+type rtSnapshot struct {
+	SelfID  string           `json:"self"`
+	SavedAt time.Time        `json:"saved_at"`
+	Buckets []bucketSnapshot `json:"buckets"`
+}
+
+type bucketSnapshot struct {
+	Lower    string            `json:"lower"`
+	Upper    string            `json:"upper"`
+	Contacts []contactSnapshot `json:"contacts"`
+}
+
+type contactSnapshot struct {
+	ID       string    `json:"id"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Writes the bucket list and all contacts to path. The file is replaced atomically so a crash
+// mid-write never leaves a half-written snapshot behind
+func (rt *RoutingTable) SaveState(path string) error {
+	rt.mu.RLock()
+	snap := rtSnapshot{SelfID: hex.EncodeToString(rt.SelfID[:]), SavedAt: time.Now()}
+	for _, b := range rt.BucketList {
+		b.mu.RLock()
+		bs := bucketSnapshot{
+			Lower: hex.EncodeToString(b.LowerLimit[:]),
+			Upper: hex.EncodeToString(b.UpperLimit[:]),
+		}
+		for _, c := range b.Contacts {
+			bs.Contacts = append(bs.Contacts, contactSnapshot{
+				ID:       hex.EncodeToString(c.ID[:]),
+				Addr:     c.Addr,
+				LastSeen: c.LastSeen,
+			})
+		}
+		b.mu.RUnlock()
+		snap.Buckets = append(snap.Buckets, bs)
+	}
+	rt.mu.RUnlock()
+
+	raw, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// synced before the rename and the directory after it, a crash must not leave a torn state file
+	_, err = tmp.Write(raw)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Reads a snapshot written by SaveState. If it was saved by a node with the same id the bucket
+// layout is restored (empty). The saved contacts are returned but NOT added, the caller is
+// expected to ping them first and only add the ones that answer
+func (rt *RoutingTable) LoadState(path string) ([]Contact, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snap rtSnapshot
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		return nil, err
+	}
+
+	var contacts []Contact
+	var buckets []*Kbucket
+	for _, bs := range snap.Buckets {
+		lower, err := decodeHexID(bs.Lower)
+		if err != nil {
+			return nil, err
+		}
+		upper, err := decodeHexID(bs.Upper)
+		if err != nil {
+			return nil, err
+		}
+		kb, _ := NewKBucket(K, lower, upper, nil)
+		buckets = append(buckets, &kb)
+
+		for _, cs := range bs.Contacts {
+			id, err := decodeHexID(cs.ID)
+			if err != nil {
+				return nil, err
+			}
+			contacts = append(contacts, Contact{ID: id, Addr: cs.Addr, LastSeen: cs.LastSeen})
+		}
+	}
+
+	self, err := decodeHexID(snap.SelfID)
+	if err == nil && self == rt.SelfID && bucketsCoverIDSpace(buckets) {
+		rt.mu.Lock()
+		if rt.isEmptyLocked() {
+			rt.BucketList = buckets
+		}
+		rt.mu.Unlock()
+	}
+	return contacts, nil
+}
+
+// true if no bucket holds any contact, caller must hold rt.mu
+func (rt *RoutingTable) isEmptyLocked() bool {
+	for _, b := range rt.BucketList {
+		b.mu.RLock()
+		n := len(b.Contacts)
+		b.mu.RUnlock()
+		if n > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// true if the buckets are sorted, contiguous and span 0..2^160-1
+func bucketsCoverIDSpace(buckets []*Kbucket) bool {
+	if len(buckets) == 0 {
+		return false
+	}
+	var zero, max [20]byte
+	for i := range max {
+		max[i] = 0xff
+	}
+	if buckets[0].LowerLimit != zero || buckets[len(buckets)-1].UpperLimit != max {
+		return false
+	}
+	for i, b := range buckets {
+		if compare(b.LowerLimit, b.UpperLimit) > 0 {
+			return false
+		}
+		if i > 0 && addOne(buckets[i-1].UpperLimit) != b.LowerLimit {
+			return false
+		}
+	}
+	return true
+}
+
+// decodes a 40 char hex string into an id
+func decodeHexID(s string) ([20]byte, error) {
+	var id [20]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != len(id) {
+		return id, errors.New("bad id length")
+	}
+	copy(id[:], b)
+	return id, nil
+}
@@ -0,0 +1,89 @@
+package node
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoutingTable_SaveLoadState_RoundTrip(t *testing.T) {
+	var lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	self := RandomNodeID()
+	rt, _ := NewRoutingTable(self, lower, upper)
+	for i := 0; i < 100; i++ {
+		rt.Touch(Contact{ID: RandomNodeID(), Addr: "127.0.0.1:1"})
+	}
+
+	path := filepath.Join(t.TempDir(), "rt.json")
+	if err := rt.SaveState(path); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+
+	want := map[[20]byte]bool{}
+	for _, b := range rt.BucketList {
+		for _, c := range b.Contacts {
+			want[c.ID] = true
+		}
+	}
+
+	// same id -> bucket layout comes back, contacts are handed out but not trusted yet
+	rt2, _ := NewRoutingTable(self, lower, upper)
+	got, err := rt2.LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d contacts, got %d", len(want), len(got))
+	}
+	for _, c := range got {
+		if !want[c.ID] || c.LastSeen.IsZero() {
+			t.Fatalf("unexpected contact %+v", c)
+		}
+	}
+	if rt2.BucketsLen() != rt.BucketsLen() {
+		t.Fatalf("expected %d buckets restored, got %d", rt.BucketsLen(), rt2.BucketsLen())
+	}
+	if !rt2.isEmptyLocked() {
+		t.Fatal("LoadState should not add contacts by itself")
+	}
+	checkBucketInvariants(t, rt2)
+
+	// different id -> only the contacts are useful
+	rt3, _ := NewRoutingTable(RandomNodeID(), lower, upper)
+	if _, err := rt3.LoadState(path); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if rt3.BucketsLen() != 1 {
+		t.Fatalf("foreign snapshot should not restore buckets, got %d", rt3.BucketsLen())
+	}
+}
+
+func TestNode_RestoreState_PingsSavedContacts(t *testing.T) {
+	alive, _ := NewNode("127.0.0.1:0", "", 10*time.Second, 5*time.Second)
+	alive.Start()
+	t.Cleanup(func() { _ = alive.Close() })
+
+	path := filepath.Join(t.TempDir(), "rt.json")
+
+	old, _ := NewNode("127.0.0.1:0", "", 10*time.Second, 5*time.Second)
+	old.RoutingTable.Update(Contact{ID: alive.NodeID, Addr: alive.Svc.Addr()})
+	old.RoutingTable.Update(Contact{ID: RandomNodeID(), Addr: "127.0.0.1:1"}) // nobody listens here
+	if err := old.RoutingTable.SaveState(path); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+	_ = old.Close()
+
+	n, _ := NewNode("127.0.0.1:0", "", 10*time.Second, 5*time.Second)
+	n.StateFile = path
+	n.Svc.Start()
+	t.Cleanup(func() { _ = n.Close() })
+	n.restoreState()
+
+	cs := n.RoutingTable.Closest(alive.NodeID, K)
+	if len(cs) != 1 || cs[0].ID != alive.NodeID {
+		t.Fatalf("expected only the live contact to be restored, got %+v", cs)
+	}
+}
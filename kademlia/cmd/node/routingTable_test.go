@@ -2,6 +2,7 @@ package node
 
 import (
 	"testing"
+	"time"
 )
 
 // helpers for readable 160-bit bounds (big-endian)
@@ -194,3 +195,354 @@ func TestRoutingTable_SplitBucket(t *testing.T) {
 		t.Errorf("expected contiguous buckets: addOne(b0.Upper) == b1.Lower; got %v vs %v", addOne(b0.UpperLimit), b1.LowerLimit)
 	}
 }
+
+func TestRoutingTable_Update_FailedSplitFallsBackToReplacements(t *testing.T) {
+	var self, lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	rt, err := NewRoutingTable(self, lower, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := rt.BucketList[0]
+	for i := 1; i <= origin.Capacity; i++ {
+		rt.Update(contactWithFirstByte(byte(i)))
+	}
+	// a stray bucket with the range of the upper half makes the split fail on adding that half
+	stray, _ := NewKBucket(origin.Capacity, addOne(midpoint(lower, upper)), upper, nil)
+	rt.BucketList = append(rt.BucketList, &stray)
+
+	newcomer := contactWithFirstByte(0x30)
+	done := make(chan struct{})
+	go func() {
+		rt.Update(newcomer)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Update kept trying to split a bucket that cannot be split")
+	}
+	if rt.BucketList[0] != origin || len(origin.Contacts) != origin.Capacity {
+		t.Fatal("a failed split should leave the bucket as it was")
+	}
+	if len(origin.Replacements) != 1 || origin.Replacements[0].ID != newcomer.ID {
+		t.Fatalf("newcomer should go to the replacement cache, got %+v", origin.Replacements)
+	}
+}
+
+func TestMidpoint(t *testing.T) {
+	var zero, max [20]byte
+	for i := range max {
+		max[i] = 0xFF
+	}
+	want := upperWithFirstByte(0x7F) // 7F FF .. FF
+	if got := midpoint(zero, max); got != want {
+		t.Fatalf("midpoint(0, max) = %x, want %x", got, want)
+	}
+	// upper half: [80 00.., FF FF..] -> BF FF..
+	if got := midpoint(idWithFirstByte(0x80), max); got != upperWithFirstByte(0xBF) {
+		t.Fatalf("midpoint(80.., max) = %x, want %x", got, upperWithFirstByte(0xBF))
+	}
+}
+
+// fills a bucket far from self (self is 00..00, contacts are 0x80..) and returns its head contact
+func fillRoutingTable(t *testing.T, rt *RoutingTable) Contact {
+	t.Helper()
+	for i := 0; i < rt.BucketList[0].Capacity; i++ {
+		rt.Update(contactWithFirstByte(byte(0x80 + i)))
+	}
+	return rt.BucketList[0].Contacts[0]
+}
+
+// returns the bucket currently holding id
+func bucketFor(rt *RoutingTable, id [20]byte) *Kbucket {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.BucketList[rt.bucketIndexFor(id)]
+}
+
+// waits until no head pings are in flight
+func waitForPings(t *testing.T, rt *RoutingTable) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		rt.mu.RLock()
+		n := len(rt.pinging)
+		rt.mu.RUnlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("head ping did not finish")
+}
+
+func TestRoutingTable_Update_PingBeforeEvict_AliveHeadStays(t *testing.T) {
+	var self, lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	rt, _ := NewRoutingTable(self, lower, upper)
+	rt.Ping = func(c Contact) bool { return true }
+
+	head := fillRoutingTable(t, rt)
+	newcomer := contactWithFirstByte(0xEE)
+	rt.Update(newcomer)
+	waitForPings(t, rt)
+
+	kb := bucketFor(rt, head.ID)
+	if kb.Contacts[len(kb.Contacts)-1].ID != head.ID {
+		t.Fatalf("alive head should be moved to tail")
+	}
+	for _, c := range kb.Contacts {
+		if c.ID == newcomer.ID {
+			t.Fatal("newcomer should not displace a live contact")
+		}
+	}
+	if len(kb.Replacements) != 1 || kb.Replacements[0].ID != newcomer.ID {
+		t.Fatalf("newcomer should wait in replacement cache, got %+v", kb.Replacements)
+	}
+}
+
+func TestRoutingTable_Update_PingBeforeEvict_DeadHeadReplaced(t *testing.T) {
+	var self, lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	rt, _ := NewRoutingTable(self, lower, upper)
+	rt.Ping = func(c Contact) bool { return false }
+
+	head := fillRoutingTable(t, rt)
+	newcomer := contactWithFirstByte(0xEE)
+	rt.Update(newcomer)
+	waitForPings(t, rt)
+
+	kb := bucketFor(rt, newcomer.ID)
+	if len(kb.Contacts) != kb.Capacity {
+		t.Fatalf("bucket should still be full, got %d", len(kb.Contacts))
+	}
+	for _, c := range kb.Contacts {
+		if c.ID == head.ID {
+			t.Fatal("dead head should have been evicted")
+		}
+	}
+	if kb.Contacts[len(kb.Contacts)-1].ID != newcomer.ID {
+		t.Fatal("newcomer should backfill the bucket")
+	}
+}
+
+// checks that buckets are sorted, dont overlap and together cover 0..2^160-1
+func checkBucketInvariants(t *testing.T, rt *RoutingTable) {
+	t.Helper()
+	var zero, max [20]byte
+	for i := range max {
+		max[i] = 0xFF
+	}
+	if len(rt.BucketList) == 0 {
+		t.Fatal("routing table has no buckets")
+	}
+	if rt.BucketList[0].LowerLimit != zero {
+		t.Fatalf("first bucket should start at 0, got %x", rt.BucketList[0].LowerLimit)
+	}
+	if last := rt.BucketList[len(rt.BucketList)-1]; last.UpperLimit != max {
+		t.Fatalf("last bucket should end at 2^160-1, got %x", last.UpperLimit)
+	}
+	for i, b := range rt.BucketList {
+		if compare(b.LowerLimit, b.UpperLimit) > 0 {
+			t.Fatalf("bucket[%d] has lower > upper", i)
+		}
+		for _, c := range b.Contacts {
+			if compare(c.ID, b.LowerLimit) < 0 || compare(c.ID, b.UpperLimit) > 0 {
+				t.Fatalf("bucket[%d] holds contact %x outside its range", i, c.ID[:4])
+			}
+		}
+		if len(b.Contacts) > b.Capacity {
+			t.Fatalf("bucket[%d] over capacity: %d", i, len(b.Contacts))
+		}
+		if i > 0 && addOne(rt.BucketList[i-1].UpperLimit) != b.LowerLimit {
+			t.Fatalf("bucket[%d] and bucket[%d] are not contiguous", i-1, i)
+		}
+		if !prefixAligned(b.LowerLimit, b.UpperLimit) {
+			t.Fatalf("bucket[%d] [%x, %x] is not a prefix range", i, b.LowerLimit, b.UpperLimit)
+		}
+	}
+}
+
+// reports whether [lower, upper] is all ids sharing one prefix: a power of two in size, starting at
+// a multiple of it. then lower^upper is a run of low one bits and lower has none of them set
+func prefixAligned(lower, upper [20]byte) bool {
+	ones := false // seen the first bit where they differ
+	for i := 0; i < 20; i++ {
+		x := lower[i] ^ upper[i]
+		for bit := 7; bit >= 0; bit-- {
+			m := byte(1) << bit
+			switch {
+			case x&m != 0:
+				ones = true
+				if lower[i]&m != 0 {
+					return false
+				}
+			case ones:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestRoutingTable_Update_SplitsBucketCoveringSelf(t *testing.T) {
+	var lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	self := RandomNodeID()
+	rt, _ := NewRoutingTable(self, lower, upper)
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		rt.Update(Contact{ID: RandomNodeID(), Addr: "127.0.0.1:1"})
+	}
+
+	if rt.BucketsLen() < 2 {
+		t.Fatalf("expected buckets to split, got %d", rt.BucketsLen())
+	}
+	checkBucketInvariants(t, rt)
+
+	total := 0
+	for _, b := range rt.BucketList {
+		total += len(b.Contacts)
+	}
+	if total <= K {
+		t.Fatalf("expected more than %d contacts after splitting, got %d", K, total)
+	}
+
+	// bucket holding our own id must not be full of strangers with room to spare elsewhere
+	own := bucketFor(rt, self)
+	if compare(self, own.LowerLimit) < 0 || compare(self, own.UpperLimit) > 0 {
+		t.Fatal("self bucket lookup returned a bucket not covering self")
+	}
+}
+
+func TestRoutingTable_Update_RelaxedSplitKeepsCloseContacts(t *testing.T) {
+	var self, lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	rt, _ := NewRoutingTable(self, lower, upper)
+
+	// fill the far half of the space so it ends up in its own full bucket
+	fillRoutingTable(t, rt)
+	// one contact in the near half, so the far bucket cant hold the k closest on its own
+	rt.Update(contactWithFirstByte(0x01))
+
+	// 0x80..01 is closer to self than anything already in the far bucket except 0x80..00,
+	// so the relaxed rule lets that bucket split instead of dropping the newcomer
+	close := Contact{ID: idWithFirstByte(0x80), Addr: "127.0.0.1:2"}
+	close.ID[19] = 0x01
+	rt.Update(close)
+	checkBucketInvariants(t, rt)
+
+	kb := bucketFor(rt, close.ID)
+	found := false
+	for _, c := range kb.Contacts {
+		if c.ID == close.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected close contact to be admitted by the relaxed split rule\n%s", rt.Dump())
+	}
+}
+
+func TestRoutingTable_Touch_StampsLastSeen(t *testing.T) {
+	var self, lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	rt, _ := NewRoutingTable(self, lower, upper)
+
+	c := contactWithFirstByte(0x42)
+	rt.Touch(c)
+	got := rt.BucketList[0].Contacts[0]
+	if got.LastSeen.IsZero() {
+		t.Fatal("Touch should stamp LastSeen")
+	}
+
+	// hearing about the contact from someone else must not wipe the stamp
+	rt.Update(c)
+	if rt.BucketList[0].Contacts[0].LastSeen != got.LastSeen {
+		t.Fatal("Update with a zero LastSeen should keep the old stamp")
+	}
+}
+
+func TestRoutingTable_StaleBuckets(t *testing.T) {
+	var self, lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	rt, _ := NewRoutingTable(self, lower, upper)
+	rt.BucketList[0].RefreshedAt = time.Now().Add(-2 * time.Hour)
+
+	stale := rt.StaleBuckets(time.Now().Add(-time.Hour))
+	if len(stale) != 1 || stale[0][0] != lower || stale[0][1] != upper {
+		t.Fatalf("expected the untouched bucket to be stale, got %v", stale)
+	}
+	// it was marked refreshed, so asking again right away returns nothing
+	if again := rt.StaleBuckets(time.Now().Add(-time.Hour)); len(again) != 0 {
+		t.Fatalf("expected no stale buckets right after refresh, got %d", len(again))
+	}
+
+	// a recently seen contact keeps the bucket fresh
+	rt.BucketList[0].RefreshedAt = time.Now().Add(-2 * time.Hour)
+	rt.Touch(contactWithFirstByte(0x42))
+	if stale := rt.StaleBuckets(time.Now().Add(-time.Hour)); len(stale) != 0 {
+		t.Fatalf("bucket with a fresh contact should not be stale, got %d", len(stale))
+	}
+}
+
+func TestRoutingTable_RecordFailure_EvictsAfterThreshold(t *testing.T) {
+	var self, lower, upper [20]byte
+	for i := range upper {
+		upper[i] = 0xFF
+	}
+	rt, _ := NewRoutingTable(self, lower, upper)
+	rt.MaxFailures = 2
+
+	head := fillRoutingTable(t, rt)
+
+	// newcomer waits in the replacement cache (no Ping set, so the head is kept)
+	newcomer := contactWithFirstByte(0xEE)
+	rt.Update(newcomer)
+
+	head.Addr = "dead:9999"
+	kb := bucketFor(rt, head.ID)
+	kb.Contacts[0].Addr = head.Addr
+
+	rt.RecordFailure(head.Addr)
+	if kb.Contacts[0].ID != head.ID || kb.Contacts[0].Failures != 1 {
+		t.Fatalf("one failure should only bump the counter, got %+v", kb.Contacts[0])
+	}
+
+	// a success in between resets the counter, stamps LastSeen and moves the contact to the tail
+	rt.RecordSuccess(head.Addr)
+	last := kb.Contacts[len(kb.Contacts)-1]
+	if last.ID != head.ID || last.Failures != 0 || time.Since(last.LastSeen) > time.Second {
+		t.Fatalf("RecordSuccess should refresh the contact like Update, got %+v", last)
+	}
+	rt.RecordFailure(head.Addr)
+	if last := kb.Contacts[len(kb.Contacts)-1]; last.ID != head.ID {
+		t.Fatal("counter should have been reset by RecordSuccess")
+	}
+
+	rt.RecordFailure(head.Addr)
+	for _, c := range kb.Contacts {
+		if c.ID == head.ID {
+			t.Fatal("contact should be evicted after MaxFailures failures")
+		}
+	}
+	if kb.Contacts[len(kb.Contacts)-1].ID != newcomer.ID {
+		t.Fatal("evicted contact should be replaced from the replacement cache")
+	}
+}
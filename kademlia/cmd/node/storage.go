@@ -0,0 +1,92 @@
+package node
+
+import (
+	"sync"
+	"time"
+)
+
+// Storage holds the values a node keeps for the network. the node only ever goes through this
+// interface, so values can live in memory (MemoryStore) or on disk (DirStore). implementations must
+// be safe for concurrent use
+type Storage interface {
+	Get(key [20]byte) (Value, bool)
+	Put(key [20]byte, v Value) error
+	Delete(key [20]byte) (bool, error)
+	// sets the expiry of a stored value, false if there is no value under key
+	Touch(key [20]byte, expiresAt time.Time) (bool, error)
+	// calls f for every stored value until f returns false. f must not call back into the store
+	Iterate(f func(key [20]byte, v Value) bool) error
+	// drops every value that expired before now and returns how many there were
+	Expire(now time.Time) (int, error)
+	Close() error
+}
+
+// MemoryStore keeps values in a map, they are gone when the node stops
+type MemoryStore struct {
+	mu   sync.RWMutex
+	vals map[[20]byte]Value
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{vals: make(map[[20]byte]Value)}
+}
+
+func (s *MemoryStore) Get(key [20]byte) (Value, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.vals[key]
+	return v, ok
+}
+
+func (s *MemoryStore) Put(key [20]byte, v Value) error {
+	v.Data = append([]byte{}, v.Data...)
+	s.mu.Lock()
+	s.vals[key] = v
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Delete(key [20]byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.vals[key]
+	delete(s.vals, key)
+	return ok, nil
+}
+
+func (s *MemoryStore) Touch(key [20]byte, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.vals[key]
+	if ok {
+		v.ExpiresAt = expiresAt
+		s.vals[key] = v
+	}
+	return ok, nil
+}
+
+func (s *MemoryStore) Iterate(f func(key [20]byte, v Value) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k, v := range s.vals {
+		if !f(k, v) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Expire(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for k, v := range s.vals {
+		if !v.ExpiresAt.IsZero() && now.After(v.ExpiresAt) {
+			delete(s.vals, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) Close() error { return nil }
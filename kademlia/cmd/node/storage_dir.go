@@ -0,0 +1,261 @@
+package node
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DirStore keeps every value in its own file, named by the hex key, under one directory. nothing is
+// held in memory, so the store survives restarts and can grow past RAM.
+//
+// file: version(1) + flags(1) + last publish unix ns(8) + expires at unix ns(8) + ttl ns(8) + data
+type DirStore struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+const (
+	dirHeader = 1 + 1 + 8 + 8 + 8
+
+	// the version of the value header. the files from before it started with the flags byte, which
+	// never has the high bit set, so they cannot pass for any version
+	valueVersion byte = 0x80 | 1
+
+	flagOrigin byte = 1 << 0
+	flagCached byte = 1 << 1
+)
+
+// opens (and creates if needed) a DirStore in dir
+func OpenDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+func (s *DirStore) path(key [20]byte) string {
+	return filepath.Join(s.dir, hex.EncodeToString(key[:]))
+}
+
+func unixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func fromUnixNano(n uint64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(n))
+}
+
+func valueFlags(v Value) byte {
+	var f byte
+	if v.Origin {
+		f |= flagOrigin
+	}
+	if v.Cached {
+		f |= flagCached
+	}
+	return f
+}
+
+var errValueVersion = errors.New("value written by another version of the store")
+
+// encodes version, flags, times and ttl of v, the data follows it
+func encodeValueHeader(v Value) []byte {
+	h := make([]byte, dirHeader)
+	h[0] = valueVersion
+	h[1] = valueFlags(v)
+	binary.BigEndian.PutUint64(h[2:10], unixNano(v.LastPublish))
+	binary.BigEndian.PutUint64(h[10:18], unixNano(v.ExpiresAt))
+	binary.BigEndian.PutUint64(h[18:26], uint64(v.TTL))
+	return h
+}
+
+func decodeValueHeader(h []byte) (Value, error) {
+	if h[0] != valueVersion {
+		return Value{}, errValueVersion
+	}
+	return Value{
+		Origin:      h[1]&flagOrigin != 0,
+		Cached:      h[1]&flagCached != 0,
+		LastPublish: fromUnixNano(binary.BigEndian.Uint64(h[2:10])),
+		ExpiresAt:   fromUnixNano(binary.BigEndian.Uint64(h[10:18])),
+		TTL:         time.Duration(binary.BigEndian.Uint64(h[18:26])),
+	}, nil
+}
+
+func (s *DirStore) read(key [20]byte) (Value, error) {
+	raw, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return Value{}, err
+	}
+	if len(raw) < dirHeader {
+		return Value{}, errors.New("short value file")
+	}
+	v, err := decodeValueHeader(raw[:dirHeader])
+	if err != nil {
+		return Value{}, err
+	}
+	v.Data = raw[dirHeader:]
+	return v, nil
+}
+
+func (s *DirStore) Get(key [20]byte) (Value, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, err := s.read(key)
+	return v, err == nil
+}
+
+// the file is replaced atomically, a crash never leaves half a value behind
+func (s *DirStore) Put(key [20]byte, v Value) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp, err := os.CreateTemp(s.dir, ".tmp*")
+	if err != nil {
+		return err
+	}
+	// the data has to be on disk before the rename makes it the value, and the rename itself only
+	// sticks once the directory is synced
+	_, err = tmp.Write(append(encodeValueHeader(v), v.Data...))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(key)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *DirStore) Delete(key [20]byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *DirStore) Touch(key [20]byte, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path(key), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var b [8]byte
+	_, err = f.ReadAt(b[:1], 0)
+	if err == nil && b[0] != valueVersion {
+		err = errValueVersion // the expiry is somewhere else in that file
+	}
+	if err == nil {
+		binary.BigEndian.PutUint64(b[:], unixNano(expiresAt))
+		_, err = f.WriteAt(b[:], 10)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err == nil, err
+}
+
+// the keys of all value files in the directory
+func (s *DirStore) keys() ([][20]byte, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][20]byte
+	for _, e := range entries {
+		b, err := hex.DecodeString(e.Name())
+		if err != nil || len(b) != 20 || !e.Type().IsRegular() {
+			continue // temp files and anything else that is not ours
+		}
+		var k [20]byte
+		copy(k[:], b)
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (s *DirStore) Iterate(f func(key [20]byte, v Value) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys, err := s.keys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		v, err := s.read(k)
+		if err != nil {
+			continue
+		}
+		if !f(k, v) {
+			break
+		}
+	}
+	return nil
+}
+
+// only reads the header of every file
+func (s *DirStore) Expire(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys, err := s.keys()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, k := range keys {
+		f, err := os.Open(s.path(k))
+		if err != nil {
+			continue
+		}
+		h := make([]byte, dirHeader)
+		_, err = io.ReadFull(f, h)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		if v, err := decodeValueHeader(h); err == nil && !v.ExpiresAt.IsZero() && now.After(v.ExpiresAt) {
+			if os.Remove(s.path(k)) == nil {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+func (s *DirStore) Close() error { return nil }
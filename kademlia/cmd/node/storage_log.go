@@ -0,0 +1,634 @@
+package node
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogStore appends every change to a log of segment files on local disk and keeps only an index of
+// where each value lives in memory. on open the segments are replayed to rebuild the index, a torn
+// last record (crash halfway through a write) is cut off. compaction copies the values that are
+// still live into a new segment and drops the old ones, which is how expired and forgotten values
+// leave the disk.
+//
+// segment: magic(8) + base segment number(8) + records
+// record:  crc32 of body(4) + body length(4) + body
+// body:    op(1) + key(20) + put: value header(26) + data | touch: expires at unix ns(8) | delete: -
+//
+// a compacted segment takes the number of the newest segment it replaces and records the oldest as
+// its base, so leftovers of an interrupted compaction can be told apart and removed on open.
+//
+// segments are synced when they are sealed and on Close, so a stopped or crashed process loses
+// nothing, a crashed machine may lose the last writes.
+type LogStore struct {
+	SegmentSize int64 // the active segment is sealed once it grows past this
+
+	dir string
+
+	mu     sync.RWMutex
+	index  map[[20]byte]logEntry
+	segs   map[uint64]*logSegment
+	active uint64
+
+	compactMu sync.Mutex // one compaction at a time
+	stop      chan struct{}
+	done      chan struct{}
+	closed    bool
+}
+
+const (
+	DefaultSegmentSize     = 8 << 20
+	DefaultCompactInterval = time.Minute // how often the background compaction looks for garbage
+)
+
+const (
+	logHeader    = 8 + 8
+	recordHeader = 4 + 4
+	maxRecord    = 1 + 20 + dirHeader + MaxObjectSize // anything longer is garbage, not a record
+
+	opPut    byte = 1
+	opTouch  byte = 2
+	opDelete byte = 3
+)
+
+// segments of another format version are refused on open
+const logVersion = '2'
+
+var logMagic = []byte("KADLOG" + string(rune(logVersion)) + "\n")
+
+type logSegment struct {
+	f    *os.File
+	size int64 // bytes written, the next record goes here
+	live int64 // bytes of records the index still points at
+}
+
+// where a value lives and what the index knows about it without reading the data
+type logEntry struct {
+	seg     uint64
+	off     int64 // of the record
+	size    int64 // of the whole record
+	meta    Value // everything but Data
+	dataLen int
+}
+
+func segmentName(n uint64) string { return fmt.Sprintf("%016d.seg", n) }
+
+// OpenLogStore opens (and creates if needed) a LogStore in dir and starts its background
+// compaction. values that expired while the store was closed are not brought back
+func OpenLogStore(dir string) (*LogStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &LogStore{
+		SegmentSize: DefaultSegmentSize,
+		dir:         dir,
+		index:       make(map[[20]byte]logEntry),
+		segs:        make(map[uint64]*logSegment),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	go s.compactLoop()
+	return s, nil
+}
+
+// finds the segments in dir, drops what an interrupted compaction left behind and replays the rest
+// in order
+func (s *LogStore) recover() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var nums []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".compact") {
+			_ = os.Remove(filepath.Join(s.dir, name)) // a compaction that never finished
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(name, ".seg"), 10, 64)
+		if err != nil || !strings.HasSuffix(name, ".seg") || !e.Type().IsRegular() {
+			continue
+		}
+		nums = append(nums, n)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	bases := make(map[uint64]uint64)
+	for _, n := range nums {
+		base, err := readSegmentBase(filepath.Join(s.dir, segmentName(n)))
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", n, err)
+		}
+		bases[n] = base
+	}
+	replaced := make(map[uint64]bool)
+	for _, n := range nums {
+		for _, m := range nums {
+			if m >= bases[n] && m < n {
+				replaced[m] = true
+			}
+		}
+	}
+
+	now := time.Now()
+	for _, n := range nums {
+		path := filepath.Join(s.dir, segmentName(n))
+		if replaced[n] {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.replay(n, path, now); err != nil {
+			return fmt.Errorf("segment %d: %w", n, err)
+		}
+		s.active = n // the newest one carries on, its torn tail is gone
+	}
+	if len(s.segs) == 0 {
+		return s.openActive(1)
+	}
+	return nil
+}
+
+// the base of a segment file, a file too short to even hold its header is taken to be its own base
+func readSegmentBase(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := make([]byte, logHeader)
+	if _, err := io.ReadFull(f, h); err != nil {
+		n, _ := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".seg"), 10, 64)
+		return n, nil
+	}
+	switch magic := h[:len(logMagic)]; {
+	case string(magic) == string(logMagic):
+	case string(magic[:6]) == "KADLOG":
+		return 0, fmt.Errorf("log segment of format version %c, this store reads version %c", magic[6], logVersion)
+	default:
+		return 0, errors.New("not a log segment")
+	}
+	return binary.BigEndian.Uint64(h[len(logMagic):]), nil
+}
+
+// reads the records of one segment into the index. the segment is cut off at the first record that
+// is incomplete or does not match its checksum
+func (s *LogStore) replay(n uint64, path string, now time.Time) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	seg := &logSegment{f: f}
+	s.segs[n] = seg
+
+	r := bufio.NewReader(f)
+	h := make([]byte, logHeader)
+	if _, err := io.ReadFull(r, h); err != nil {
+		// torn while being created, start it over
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(segmentHeader(n), 0); err != nil {
+			return err
+		}
+		seg.size = logHeader
+		return nil
+	}
+
+	off := int64(logHeader)
+	rh := make([]byte, recordHeader)
+	for {
+		if _, err := io.ReadFull(r, rh); err != nil {
+			break
+		}
+		sum := binary.BigEndian.Uint32(rh[0:4])
+		blen := int64(binary.BigEndian.Uint32(rh[4:8]))
+		if blen < 1+20 || blen > maxRecord {
+			break
+		}
+		body := make([]byte, blen)
+		if _, err := io.ReadFull(r, body); err != nil || crc32.ChecksumIEEE(body) != sum {
+			break
+		}
+		s.apply(n, off, body, now)
+		off += recordHeader + blen
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() > off {
+		if err := f.Truncate(off); err != nil {
+			return err
+		}
+	}
+	seg.size = off
+	return nil
+}
+
+// applies one record found at n/off while replaying
+func (s *LogStore) apply(n uint64, off int64, body []byte, now time.Time) {
+	var key [20]byte
+	copy(key[:], body[1:21])
+	size := int64(recordHeader + len(body))
+	switch body[0] {
+	case opPut:
+		if len(body) < 21+dirHeader {
+			return
+		}
+		s.unlink(key)
+		meta, err := decodeValueHeader(body[21 : 21+dirHeader])
+		if err != nil || (!meta.ExpiresAt.IsZero() && now.After(meta.ExpiresAt)) {
+			return
+		}
+		s.link(key, logEntry{seg: n, off: off, size: size, meta: meta, dataLen: len(body) - 21 - dirHeader})
+	case opTouch:
+		e, ok := s.index[key]
+		if !ok || len(body) < 21+8 {
+			return
+		}
+		e.meta.ExpiresAt = fromUnixNano(binary.BigEndian.Uint64(body[21:29]))
+		if !e.meta.ExpiresAt.IsZero() && now.After(e.meta.ExpiresAt) {
+			s.unlink(key)
+			return
+		}
+		s.index[key] = e
+	case opDelete:
+		s.unlink(key)
+	}
+}
+
+func segmentHeader(base uint64) []byte {
+	h := make([]byte, 0, logHeader)
+	h = append(h, logMagic...)
+	return binary.BigEndian.AppendUint64(h, base)
+}
+
+func encodeRecord(op byte, key [20]byte, rest ...[]byte) []byte {
+	blen := 1 + 20
+	for _, r := range rest {
+		blen += len(r)
+	}
+	rec := make([]byte, recordHeader, recordHeader+blen)
+	rec = append(rec, op)
+	rec = append(rec, key[:]...)
+	for _, r := range rest {
+		rec = append(rec, r...)
+	}
+	binary.BigEndian.PutUint32(rec[0:4], crc32.ChecksumIEEE(rec[recordHeader:]))
+	binary.BigEndian.PutUint32(rec[4:8], uint32(blen))
+	return rec
+}
+
+// creates segment n and makes it the active one
+func (s *LogStore) openActive(n uint64) error {
+	f, err := os.OpenFile(filepath.Join(s.dir, segmentName(n)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(segmentHeader(n)); err != nil {
+		f.Close()
+		return err
+	}
+	s.segs[n] = &logSegment{f: f, size: logHeader}
+	s.active = n
+	return nil
+}
+
+// points the index for key at e
+func (s *LogStore) link(key [20]byte, e logEntry) {
+	s.unlink(key)
+	s.index[key] = e
+	s.segs[e.seg].live += e.size
+}
+
+func (s *LogStore) unlink(key [20]byte) {
+	if e, ok := s.index[key]; ok {
+		if seg := s.segs[e.seg]; seg != nil {
+			seg.live -= e.size
+		}
+		delete(s.index, key)
+	}
+}
+
+// appends rec to the active segment, sealing it first if it is full. s.mu must be held
+func (s *LogStore) append(rec []byte) (uint64, int64, error) {
+	if s.closed {
+		return 0, 0, errors.New("log store closed")
+	}
+	seg := s.segs[s.active]
+	if seg.size > logHeader && seg.size+int64(len(rec)) > s.SegmentSize {
+		if err := s.seal(); err != nil {
+			return 0, 0, err
+		}
+		seg = s.segs[s.active]
+	}
+	off := seg.size
+	if _, err := seg.f.WriteAt(rec, off); err != nil {
+		// whatever made it to the file is cut off by the next open, or overwritten by the next append
+		return 0, 0, err
+	}
+	seg.size += int64(len(rec))
+	return s.active, off, nil
+}
+
+// syncs the active segment and starts a new one. s.mu must be held
+func (s *LogStore) seal() error {
+	if err := s.segs[s.active].f.Sync(); err != nil {
+		return err
+	}
+	return s.openActive(s.active + 1)
+}
+
+func (s *LogStore) Get(key [20]byte) (Value, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.index[key]
+	if !ok {
+		return Value{}, false
+	}
+	v, err := s.read(e)
+	return v, err == nil
+}
+
+// reads the value e points at. s.mu must be held
+func (s *LogStore) read(e logEntry) (Value, error) {
+	data := make([]byte, e.dataLen)
+	if _, err := s.segs[e.seg].f.ReadAt(data, e.off+recordHeader+1+20+dirHeader); err != nil {
+		return Value{}, err
+	}
+	v := e.meta
+	v.Data = data
+	return v, nil
+}
+
+func (s *LogStore) Put(key [20]byte, v Value) error {
+	rec := encodeRecord(opPut, key, encodeValueHeader(v), v.Data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seg, off, err := s.append(rec)
+	if err != nil {
+		return err
+	}
+	meta := v
+	meta.Data = nil
+	s.link(key, logEntry{seg: seg, off: off, size: int64(len(rec)), meta: meta, dataLen: len(v.Data)})
+	return nil
+}
+
+func (s *LogStore) Delete(key [20]byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.index[key]; !ok {
+		return false, nil
+	}
+	if _, _, err := s.append(encodeRecord(opDelete, key)); err != nil {
+		return false, err
+	}
+	s.unlink(key)
+	return true, nil
+}
+
+func (s *LogStore) Touch(key [20]byte, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.index[key]
+	if !ok {
+		return false, nil
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], unixNano(expiresAt))
+	if _, _, err := s.append(encodeRecord(opTouch, key, b[:])); err != nil {
+		return false, err
+	}
+	e.meta.ExpiresAt = expiresAt
+	s.index[key] = e
+	return true, nil
+}
+
+func (s *LogStore) Iterate(f func(key [20]byte, v Value) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k, e := range s.index {
+		v, err := s.read(e)
+		if err != nil {
+			return err
+		}
+		if !f(k, v) {
+			break
+		}
+	}
+	return nil
+}
+
+// only drops the values from the index, compaction takes them off the disk. no record is needed
+// since their expiry is in the log already
+func (s *LogStore) Expire(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for k, e := range s.index {
+		if !e.meta.ExpiresAt.IsZero() && now.After(e.meta.ExpiresAt) {
+			s.unlink(k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Compact seals the active segment and rewrites every older segment into one that holds only the
+// values still live and not expired. writes carry on meanwhile, they go to the new active segment
+func (s *LogStore) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	// 1) seal, and take a snapshot of what is live in the sealed segments
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("log store closed")
+	}
+	if err := s.seal(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	top := s.active - 1
+	var old []uint64
+	for n := range s.segs {
+		if n <= top {
+			old = append(old, n)
+		}
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i] < old[j] })
+	type liveRec struct {
+		key [20]byte
+		e   logEntry
+	}
+	var live []liveRec
+	for k, e := range s.index {
+		if e.seg <= top {
+			live = append(live, liveRec{k, e})
+		}
+	}
+	files := make(map[uint64]*os.File, len(old))
+	for _, n := range old {
+		files[n] = s.segs[n].f
+	}
+	s.mu.Unlock()
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].e.seg != live[j].e.seg {
+			return live[i].e.seg < live[j].e.seg
+		}
+		return live[i].e.off < live[j].e.off
+	})
+
+	// 2) copy them into a temp file, with the expiry the index has now (touches included). sealed
+	// segments are never written again, so this needs no lock
+	tmp, err := os.CreateTemp(s.dir, ".compact*")
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	if _, err := w.Write(segmentHeader(old[0])); err != nil {
+		return fail(err)
+	}
+	moved := make(map[[20]byte][2]logEntry, len(live)) // old entry, new entry
+	off := int64(logHeader)
+	now := time.Now()
+	for _, l := range live {
+		if exp := l.e.meta.ExpiresAt; !exp.IsZero() && now.After(exp) {
+			continue
+		}
+		rec := make([]byte, l.e.size)
+		if _, err := files[l.e.seg].ReadAt(rec, l.e.off); err != nil {
+			return fail(err)
+		}
+		rec = encodeRecord(opPut, l.key, encodeValueHeader(l.e.meta), rec[recordHeader+1+20+dirHeader:])
+		if _, err := w.Write(rec); err != nil {
+			return fail(err)
+		}
+		ne := l.e
+		ne.seg, ne.off, ne.size = top, off, int64(len(rec))
+		moved[l.key] = [2]logEntry{l.e, ne}
+		off += int64(len(rec))
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+
+	// 3) swap it in for the newest sealed segment, move the index over and drop the rest
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, segmentName(top))); err != nil {
+		return fail(err)
+	}
+	for _, n := range old {
+		s.segs[n].f.Close()
+		delete(s.segs, n)
+	}
+	s.segs[top] = &logSegment{f: tmp, size: off}
+	for k, e := range s.index {
+		if e.seg > top {
+			continue
+		}
+		if m, ok := moved[k]; ok && m[0].seg == e.seg && m[0].off == e.off {
+			ne := m[1]
+			ne.meta = e.meta
+			s.index[k] = ne
+			s.segs[top].live += ne.size
+		} else {
+			delete(s.index, k) // expired, it was not copied
+		}
+	}
+	// the rename has to be on disk before the old segments go, or a crash could lose both
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	for _, n := range old[:len(old)-1] {
+		if err := os.Remove(filepath.Join(s.dir, segmentName(n))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reports whether at least half of what is on disk is garbage, and there is enough of it to bother
+func (s *LogStore) needsCompaction() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var size, live int64
+	for _, seg := range s.segs {
+		size += seg.size - logHeader
+		live += seg.live
+	}
+	garbage := size - live
+	return garbage >= s.SegmentSize/4 && garbage*2 >= size
+}
+
+func (s *LogStore) compactLoop() {
+	defer close(s.done)
+	t := time.NewTicker(DefaultCompactInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			if s.needsCompaction() {
+				_ = s.Compact()
+			}
+		}
+	}
+}
+
+func (s *LogStore) closeFiles() {
+	for _, seg := range s.segs {
+		seg.f.Close()
+	}
+}
+
+// stops the compaction and syncs the active segment
+func (s *LogStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.done
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.segs[s.active].f.Sync()
+	s.closeFiles()
+	return err
+}
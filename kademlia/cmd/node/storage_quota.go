@@ -0,0 +1,188 @@
+package node
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the store has no room for a value and nothing it may evict for it
+var ErrStoreFull = errors.New("store full")
+
+// QuotaStore caps another Storage at MaxBytes of value data and MaxKeys values (0 = no limit). when a
+// Put does not fit it evicts values that matter less than the new one: cached copies first, then
+// replicas, the ones furthest from our own id first within each. origin values are never evicted. if
+// that does not free enough room the Put fails with ErrStoreFull and nothing is evicted
+type QuotaStore struct {
+	MaxBytes int64
+	MaxKeys  int
+
+	inner Storage
+	self  [20]byte
+
+	mu    sync.Mutex // held by everything that changes the store, so usage stays in step with it
+	usage map[[20]byte]quotaEntry
+	bytes int64
+}
+
+// what the quota needs to know about a stored value
+type quotaEntry struct {
+	size      int64
+	rank      int
+	expiresAt time.Time
+}
+
+// values of a lower rank are evicted first
+const (
+	rankCached = iota
+	rankReplica
+	rankOrigin
+)
+
+func valueRank(v Value) int {
+	switch {
+	case v.Origin:
+		return rankOrigin
+	case v.Cached:
+		return rankCached
+	default:
+		return rankReplica
+	}
+}
+
+// NewQuotaStore wraps inner, which may already hold values. self is the id of the node the store
+// belongs to, distance to it decides which values go first
+func NewQuotaStore(inner Storage, self [20]byte, maxBytes int64, maxKeys int) (*QuotaStore, error) {
+	s := &QuotaStore{MaxBytes: maxBytes, MaxKeys: maxKeys, inner: inner, self: self, usage: make(map[[20]byte]quotaEntry)}
+	err := inner.Iterate(func(key [20]byte, v Value) bool {
+		s.usage[key] = quotaEntry{size: int64(len(v.Data)), rank: valueRank(v), expiresAt: v.ExpiresAt}
+		s.bytes += int64(len(v.Data))
+		return true
+	})
+	return s, err
+}
+
+// Usage returns the bytes of value data and the number of values held
+func (s *QuotaStore) Usage() (int64, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes, len(s.usage)
+}
+
+func (s *QuotaStore) Get(key [20]byte) (Value, bool) { return s.inner.Get(key) }
+
+func (s *QuotaStore) Put(key [20]byte, v Value) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in := quotaEntry{size: int64(len(v.Data)), rank: valueRank(v), expiresAt: v.ExpiresAt}
+	victims, err := s.victims(key, in)
+	if err != nil {
+		return err
+	}
+	for _, k := range victims {
+		if _, err := s.inner.Delete(k); err != nil {
+			return err
+		}
+		s.forget(k)
+	}
+	if err := s.inner.Put(key, v); err != nil {
+		return err
+	}
+	s.forget(key)
+	s.usage[key] = in
+	s.bytes += in.size
+	return nil
+}
+
+// picks the values to evict so that in fits under key, lowest rank and furthest from us first
+func (s *QuotaStore) victims(key [20]byte, in quotaEntry) ([][20]byte, error) {
+	bytes, keys := s.bytes+in.size, len(s.usage)+1
+	if old, ok := s.usage[key]; ok {
+		bytes, keys = bytes-old.size, keys-1
+	}
+	if s.fits(bytes, keys) {
+		return nil, nil
+	}
+	if s.MaxBytes > 0 && in.size > s.MaxBytes {
+		return nil, ErrStoreFull
+	}
+
+	dist := xor(key, s.self)
+	var cands [][20]byte
+	for k, e := range s.usage {
+		if k == key || e.rank == rankOrigin {
+			continue
+		}
+		if e.rank < in.rank || (e.rank == in.rank && less160(dist, xor(k, s.self))) {
+			cands = append(cands, k)
+		}
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		a, b := s.usage[cands[i]], s.usage[cands[j]]
+		if a.rank != b.rank {
+			return a.rank < b.rank
+		}
+		return less160(xor(cands[j], s.self), xor(cands[i], s.self))
+	})
+
+	for i, k := range cands {
+		bytes, keys = bytes-s.usage[k].size, keys-1
+		if s.fits(bytes, keys) {
+			return cands[:i+1], nil
+		}
+	}
+	return nil, ErrStoreFull
+}
+
+func (s *QuotaStore) fits(bytes int64, keys int) bool {
+	return (s.MaxBytes <= 0 || bytes <= s.MaxBytes) && (s.MaxKeys <= 0 || keys <= s.MaxKeys)
+}
+
+// drops key from the usage. s.mu must be held
+func (s *QuotaStore) forget(key [20]byte) {
+	if e, ok := s.usage[key]; ok {
+		s.bytes -= e.size
+		delete(s.usage, key)
+	}
+}
+
+func (s *QuotaStore) Delete(key [20]byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok, err := s.inner.Delete(key)
+	if err == nil {
+		s.forget(key)
+	}
+	return ok, err
+}
+
+func (s *QuotaStore) Touch(key [20]byte, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok, err := s.inner.Touch(key, expiresAt)
+	if e, in := s.usage[key]; ok && in {
+		e.expiresAt = expiresAt
+		s.usage[key] = e
+	}
+	return ok, err
+}
+
+func (s *QuotaStore) Iterate(f func(key [20]byte, v Value) bool) error { return s.inner.Iterate(f) }
+
+func (s *QuotaStore) Expire(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := s.inner.Expire(now)
+	if err != nil {
+		return n, err
+	}
+	for k, e := range s.usage {
+		if !e.expiresAt.IsZero() && now.After(e.expiresAt) {
+			s.forget(k)
+		}
+	}
+	return n, nil
+}
+
+func (s *QuotaStore) Close() error { return s.inner.Close() }
@@ -0,0 +1,382 @@
+package node
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// runs f against every Storage backend
+func forEachStore(t *testing.T, f func(t *testing.T, s Storage)) {
+	t.Run("memory", func(t *testing.T) { f(t, NewMemoryStore()) })
+	t.Run("dir", func(t *testing.T) {
+		s, err := OpenDirStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = s.Close() })
+		f(t, s)
+	})
+	t.Run("log", func(t *testing.T) {
+		s, err := OpenLogStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = s.Close() })
+		f(t, s)
+	})
+}
+
+func TestStorage_PutGetDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Storage) {
+		key := SHA1ID([]byte("v"))
+		pub := time.Now().Add(-time.Minute).Round(0)
+		exp := time.Now().Add(time.Hour).Round(0)
+		if err := s.Put(key, Value{Data: []byte("v"), Origin: true, LastPublish: pub, ExpiresAt: exp, TTL: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+		v, ok := s.Get(key)
+		if !ok || !bytes.Equal(v.Data, []byte("v")) || !v.Origin || v.Cached {
+			t.Fatalf("bad value: %+v %v", v, ok)
+		}
+		if !v.LastPublish.Equal(pub) || !v.ExpiresAt.Equal(exp) || v.TTL != time.Hour {
+			t.Fatalf("times not kept: %v %v %v", v.LastPublish, v.ExpiresAt, v.TTL)
+		}
+
+		// empty values are values too
+		empty := SHA1ID(nil)
+		if err := s.Put(empty, Value{Cached: true}); err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := s.Get(empty); !ok || len(v.Data) != 0 || !v.Cached {
+			t.Fatalf("empty value: %+v %v", v, ok)
+		}
+
+		if ok, err := s.Delete(key); !ok || err != nil {
+			t.Fatalf("delete: %v %v", ok, err)
+		}
+		if _, ok := s.Get(key); ok {
+			t.Fatal("value still there after delete")
+		}
+		if ok, _ := s.Delete(key); ok {
+			t.Fatal("second delete should report nothing deleted")
+		}
+	})
+}
+
+func TestStorage_TouchAndExpire(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Storage) {
+		now := time.Now()
+		old, fresh, forever := SHA1ID([]byte("old")), SHA1ID([]byte("fresh")), SHA1ID([]byte("forever"))
+		_ = s.Put(old, Value{Data: []byte("old"), ExpiresAt: now.Add(-time.Second)})
+		_ = s.Put(fresh, Value{Data: []byte("fresh"), ExpiresAt: now.Add(-time.Second)})
+		_ = s.Put(forever, Value{Data: []byte("forever")})
+
+		if ok, err := s.Touch(fresh, now.Add(time.Hour)); !ok || err != nil {
+			t.Fatalf("touch: %v %v", ok, err)
+		}
+		if ok, _ := s.Touch(SHA1ID([]byte("missing")), now); ok {
+			t.Fatal("touch of a missing key should report false")
+		}
+
+		if n, err := s.Expire(now); n != 1 || err != nil {
+			t.Fatalf("expected 1 expired, got %d %v", n, err)
+		}
+		seen := map[[20]byte]bool{}
+		_ = s.Iterate(func(k [20]byte, v Value) bool { seen[k] = true; return true })
+		if len(seen) != 2 || !seen[fresh] || !seen[forever] {
+			t.Fatalf("wrong values left: %v", seen)
+		}
+	})
+}
+
+func TestDirStore_KeepsValuesAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := SHA1ID([]byte("kept"))
+	_ = s.Put(key, Value{Data: []byte("kept"), Origin: true})
+	_ = s.Close()
+
+	s, err = OpenDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, ok := s.Get(key); !ok || string(v.Data) != "kept" || !v.Origin {
+		t.Fatalf("value lost on reopen: %+v %v", v, ok)
+	}
+}
+
+// writes, touches and deletes a few values, then checks a reopened store sees the same
+func TestLogStore_ReopenReplaysLog(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SegmentSize = 256 // a few records per segment
+	now := time.Now()
+	var keys [][20]byte
+	for i := 0; i < 20; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 50)
+		k := SHA1ID(data)
+		keys = append(keys, k)
+		if err := s.Put(k, Value{Data: data, ExpiresAt: now.Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _ = s.Delete(keys[3])
+	_, _ = s.Touch(keys[4], now.Add(-time.Second)) // expired by the time we reopen
+	_, _ = s.Touch(keys[5], now.Add(2*time.Hour))
+	_ = s.Close()
+
+	s, err = OpenLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i, k := range keys {
+		v, ok := s.Get(k)
+		switch i {
+		case 3, 4:
+			if ok {
+				t.Fatalf("value %d should be gone", i)
+			}
+		default:
+			if !ok || !bytes.Equal(v.Data, bytes.Repeat([]byte{byte(i)}, 50)) {
+				t.Fatalf("value %d lost: %v", i, ok)
+			}
+		}
+	}
+	if v, _ := s.Get(keys[5]); v.ExpiresAt.Before(now.Add(time.Hour + time.Minute)) {
+		t.Fatal("touch was not replayed")
+	}
+}
+
+func TestLogStore_TornLastRecordIsCutOff(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := SHA1ID([]byte("a")), SHA1ID([]byte("b"))
+	_ = s.Put(a, Value{Data: []byte("a")})
+	_ = s.Put(b, Value{Data: []byte("b")})
+	_ = s.Close()
+
+	// the crash hit halfway through the second record
+	seg := filepath.Join(dir, segmentName(1))
+	st, err := os.Stat(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(seg, st.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(a); !ok {
+		t.Fatal("record before the torn one was lost")
+	}
+	if _, ok := s.Get(b); ok {
+		t.Fatal("torn record should not come back")
+	}
+	// and the log carries on after the cut
+	_ = s.Put(b, Value{Data: []byte("b")})
+	_ = s.Close()
+	s, err = OpenLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, ok := s.Get(b); !ok || string(v.Data) != "b" {
+		t.Fatal("write after the cut was lost")
+	}
+}
+
+// files written before the headers had a version are refused instead of being misread
+func TestStores_RefuseOldFormat(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := OpenDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	key := SHA1ID([]byte("old"))
+	old := append(make([]byte, 1+8+8+8), "old"...) // flags + last publish + expires at + ttl
+	old[0] = flagOrigin
+	if err := os.WriteFile(ds.path(key), old, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := ds.Get(key); ok {
+		t.Fatalf("old value file was read as %+v", v)
+	}
+	if _, err := ds.Touch(key, time.Now().Add(time.Hour)); err == nil {
+		t.Fatal("touching an old value file should fail")
+	}
+	if raw, _ := os.ReadFile(ds.path(key)); !bytes.Equal(raw, old) {
+		t.Fatal("touch wrote into the old value file")
+	}
+
+	dir = t.TempDir()
+	seg := append([]byte("KADLOG1\n"), make([]byte, 8)...)
+	if err := os.WriteFile(filepath.Join(dir, segmentName(1)), seg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if ls, err := OpenLogStore(dir); err == nil {
+		ls.Close()
+		t.Fatal("a segment of the old format should not open")
+	}
+}
+
+func TestLogStore_CompactDropsGarbage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SegmentSize = 1 << 10
+	now := time.Now()
+	keep := map[[20]byte][]byte{}
+	for i := 0; i < 100; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 100)
+		k := SHA1ID(data)
+		v := Value{Data: data}
+		switch i % 3 {
+		case 0:
+			keep[k] = data
+		case 1:
+			v.ExpiresAt = now.Add(-time.Second)
+		}
+		_ = s.Put(k, v)
+		if i%3 == 2 {
+			_, _ = s.Delete(k)
+		}
+	}
+	_, _ = s.Expire(now)
+	before := dirSize(t, dir)
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if after := dirSize(t, dir); after*2 > before {
+		t.Fatalf("compaction left %d of %d bytes", after, before)
+	}
+	check := func() {
+		n := 0
+		_ = s.Iterate(func(k [20]byte, v Value) bool {
+			if !bytes.Equal(keep[k], v.Data) {
+				t.Fatalf("unexpected value under %x", k[:4])
+			}
+			n++
+			return true
+		})
+		if n != len(keep) {
+			t.Fatalf("want %d values, have %d", len(keep), n)
+		}
+	}
+	check()
+
+	// and the compacted log replays to the same values
+	_ = s.Close()
+	if s, err = OpenLogStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check()
+}
+
+func dirSize(t *testing.T, dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			n += info.Size()
+		}
+	}
+	return n
+}
+
+func TestQuotaStore_EvictsCachedAndFarValuesFirst(t *testing.T) {
+	var self [20]byte
+	s, err := NewQuotaStore(NewMemoryStore(), self, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := func(b byte) [20]byte { return [20]byte{b} } // bigger first byte = further from self
+	_ = s.Put(id(0x01), Value{Data: []byte("origin"), Origin: true})
+	_ = s.Put(id(0x10), Value{Data: []byte("near")})
+	_ = s.Put(id(0x80), Value{Data: []byte("far")})
+
+	// a nearer replica pushes out the far one
+	if err := s.Put(id(0x20), Value{Data: []byte("nearer")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(id(0x80)); ok {
+		t.Fatal("far replica should have been evicted")
+	}
+	// a replica further away than everything held does not fit
+	if err := s.Put(id(0xf0), Value{Data: []byte("furthest")}); err != ErrStoreFull {
+		t.Fatalf("expected ErrStoreFull, got %v", err)
+	}
+	// nor does a cached copy
+	if err := s.Put(id(0x02), Value{Data: []byte("cached"), Cached: true}); err != ErrStoreFull {
+		t.Fatalf("expected ErrStoreFull for a cached copy, got %v", err)
+	}
+	// origin values push out replicas but are never pushed out themselves
+	_ = s.Put(id(0x03), Value{Data: []byte("o2"), Origin: true})
+	_ = s.Put(id(0x04), Value{Data: []byte("o3"), Origin: true})
+	if err := s.Put(id(0x05), Value{Data: []byte("o4"), Origin: true}); err != ErrStoreFull {
+		t.Fatalf("store of only origin values should be full, got %v", err)
+	}
+	for _, k := range [][20]byte{id(0x01), id(0x03), id(0x04)} {
+		if v, ok := s.Get(k); !ok || !v.Origin {
+			t.Fatalf("origin value %x lost", k[0])
+		}
+	}
+	if _, keys := s.Usage(); keys != 3 {
+		t.Fatalf("usage says %d keys", keys)
+	}
+}
+
+func TestQuotaStore_ByteLimit(t *testing.T) {
+	var self [20]byte
+	s, err := NewQuotaStore(NewMemoryStore(), self, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Put([20]byte{1}, Value{Data: make([]byte, 40), Cached: true})
+	_ = s.Put([20]byte{2}, Value{Data: make([]byte, 40)})
+	if err := s.Put([20]byte{3}, Value{Data: make([]byte, 101), Origin: true}); err != ErrStoreFull {
+		t.Fatalf("value bigger than the whole quota: %v", err)
+	}
+	// 40 + 40 + 30 > 100, the cached copy has to go
+	if err := s.Put([20]byte{4}, Value{Data: make([]byte, 30)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get([20]byte{1}); ok {
+		t.Fatal("cached copy should have been evicted")
+	}
+	// overwriting a value only counts the difference
+	if err := s.Put([20]byte{4}, Value{Data: make([]byte, 60)}); err != nil {
+		t.Fatal(err)
+	}
+	if bytes, keys := s.Usage(); bytes != 100 || keys != 2 {
+		t.Fatalf("usage %d bytes %d keys", bytes, keys)
+	}
+	_, _ = s.Delete([20]byte{2})
+	if bytes, _ := s.Usage(); bytes != 60 {
+		t.Fatalf("usage %d bytes after delete", bytes)
+	}
+}
@@ -0,0 +1,234 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LookupTrace is a record of every query a lookup made, so a failing get can be followed hop by hop.
+// it is filled in by the lookup engine when a lookup runs with a trace (see TraceLookup) and is sent
+// as json to the cli
+type LookupTrace struct {
+	Key        string         `json:"key"`
+	Found      bool           `json:"found"`
+	From       string         `json:"from,omitempty"` // id of the node that answered with the value
+	Error      string         `json:"error,omitempty"`
+	DurationMs float64        `json:"duration_ms"`
+	Seeds      []TraceContact `json:"seeds"`
+	Hops       []TraceHop     `json:"hops"`
+	Truncated  int            `json:"truncated,omitempty"` // hops left out to make the trace fit
+
+	mu       sync.Mutex
+	start    time.Time
+	via      map[string]string // peer id -> id of the peer that first told us about it
+	finished bool              // answers from paths still running after the lookup returned are ignored
+}
+
+type TraceContact struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// one query made during a traced lookup
+type TraceHop struct {
+	Path        int            `json:"path"` // disjoint path that asked, always 0 for single path lookups
+	Peer        TraceContact   `json:"peer"`
+	Via         string         `json:"via,omitempty"` // who suggested Peer, empty for seeds
+	SentMs      float64        `json:"sent_ms"`       // since the lookup started
+	RTTMs       float64        `json:"rtt_ms"`
+	Returned    []TraceContact `json:"returned,omitempty"`
+	NumReturned int            `json:"num_returned"`
+	Found       bool           `json:"found,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	Dropped     bool           `json:"dropped,omitempty"` // failed and was removed from the shortlist
+	Added       int            `json:"added"`             // returned contacts that were new to the shortlist
+	Improved    bool           `json:"improved"`          // closest known distance to the key got smaller
+	Best        string         `json:"best,omitempty"`    // closest contact in the shortlist after this answer
+}
+
+func newLookupTrace(key [20]byte, seeds []Contact) *LookupTrace {
+	t := &LookupTrace{
+		Key:   hex.EncodeToString(key[:]),
+		start: time.Now(),
+		via:   make(map[string]string),
+	}
+	for _, c := range seeds {
+		tc := traceContact(c)
+		t.Seeds = append(t.Seeds, tc)
+		t.via[tc.ID] = "" // seeds stay at the top of the tree even if someone suggests them later
+	}
+	return t
+}
+
+func traceContact(c Contact) TraceContact {
+	return TraceContact{ID: hex.EncodeToString(c.ID[:]), Addr: c.Addr}
+}
+
+func sinceMs(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+// the trace of one lookup path, nil means the lookup is not traced
+type pathTrace struct {
+	t    *LookupTrace
+	path int
+}
+
+func (pt *pathTrace) hop(h TraceHop, sent time.Time, returned []Contact) {
+	if pt == nil {
+		return
+	}
+	t := pt.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	h.Path = pt.path
+	h.Via = t.via[h.Peer.ID]
+	h.SentMs = sinceMs(sent.Sub(t.start))
+	for _, c := range returned {
+		tc := traceContact(c)
+		if _, ok := t.via[tc.ID]; !ok {
+			t.via[tc.ID] = h.Peer.ID
+		}
+		h.Returned = append(h.Returned, tc)
+	}
+	h.NumReturned = len(returned)
+	t.Hops = append(t.Hops, h)
+}
+
+func (t *LookupTrace) path(p int) *pathTrace {
+	if t == nil {
+		return nil
+	}
+	return &pathTrace{t: t, path: p}
+}
+
+func (t *LookupTrace) finish(res lookupResult, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finished = true
+	t.DurationMs = sinceMs(time.Since(t.start))
+	t.Found = res.found
+	if res.found {
+		t.From = hex.EncodeToString(res.from.ID[:])
+	}
+	if err != nil {
+		t.Error = err.Error()
+	}
+	sort.SliceStable(t.Hops, func(i, j int) bool { return t.Hops[i].SentMs < t.Hops[j].SentMs })
+}
+
+// TraceLookup runs a value lookup for key from the routing table and returns the trace of it
+func (n *Node) TraceLookup(ctx context.Context, key [20]byte) *LookupTrace {
+	seeds := usableContacts(n.NodeID, n.RoutingTable.Closest(key, K))
+	tr := newLookupTrace(key, seeds)
+	res, err := n.getValue(ctx, key, seeds, tr)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		err = nil // getValue's "not found", the lookup ran out of contacts and not out of time
+	}
+	tr.finish(res, err)
+	return tr
+}
+
+// Marshal encodes the trace as json. if that gets bigger than max the returned contact lists are
+// left out, only their counts are kept, and if it still does not fit the last hops are dropped
+func (t *LookupTrace) Marshal(max int) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	raw, err := json.Marshal(t)
+	if err != nil || len(raw) <= max {
+		return raw, err
+	}
+	hops := t.Hops
+	defer func() { t.Hops, t.Truncated = hops, 0 }()
+
+	t.Hops = make([]TraceHop, len(hops))
+	for i, h := range hops {
+		h.Returned = nil
+		t.Hops[i] = h
+	}
+	for {
+		raw, err = json.Marshal(t)
+		if err != nil || len(raw) <= max || len(t.Hops) == 0 {
+			return raw, err
+		}
+		t.Hops = t.Hops[:len(t.Hops)-1]
+		t.Truncated++
+	}
+}
+
+// PrintTree writes the trace as a tree: every query is listed under the peer that told us about the
+// contact, seeds are at the top level
+func (t *LookupTrace) PrintTree(w io.Writer) {
+	status := "not found"
+	if t.Found {
+		status = "found at " + short(t.From)
+	}
+	fmt.Fprintf(w, "key %s: %s, %d queries in %.1fms\n", t.Key, status, len(t.Hops), t.DurationMs)
+	if t.Error != "" {
+		fmt.Fprintf(w, "error: %s\n", t.Error)
+	}
+	if t.Truncated > 0 {
+		fmt.Fprintf(w, "(%d later queries left out, trace too big)\n", t.Truncated)
+	}
+
+	children := make(map[string][]int)
+	queried := make(map[string]bool)
+	for i, h := range t.Hops {
+		queried[h.Peer.ID] = true
+		children[h.Via] = append(children[h.Via], i)
+	}
+	var walk func(parent string, depth int)
+	walk = func(parent string, depth int) {
+		for _, i := range children[parent] {
+			h := t.Hops[i]
+			fmt.Fprintf(w, "%s%s\n", strings.Repeat("  ", depth+1), hopLine(h))
+			walk(h.Peer.ID, depth+1)
+		}
+	}
+	walk("", 0)
+
+	// queries whose parent was never queried itself (can't happen in a normal lookup, but don't hide them)
+	for via, idx := range children {
+		if via == "" || queried[via] {
+			continue
+		}
+		for _, i := range idx {
+			fmt.Fprintf(w, "  (via %s) %s\n", short(via), hopLine(t.Hops[i]))
+		}
+	}
+}
+
+func hopLine(h TraceHop) string {
+	s := fmt.Sprintf("[p%d] %s %s  +%.1fms rtt=%.1fms", h.Path, short(h.Peer.ID), h.Peer.Addr, h.SentMs, h.RTTMs)
+	switch {
+	case h.Error != "":
+		s += "  ERROR " + h.Error
+		if h.Dropped {
+			s += " (dropped)"
+		}
+	case h.Found:
+		s += "  VALUE"
+	default:
+		s += fmt.Sprintf("  returned=%d new=%d", h.NumReturned, h.Added)
+		if h.Improved {
+			s += " closer, best=" + short(h.Best)
+		}
+	}
+	return s
+}
+
+func short(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
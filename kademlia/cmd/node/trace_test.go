@@ -0,0 +1,91 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrace_RecordsHopsAndWhoSuggestedThem(t *testing.T) {
+	n := &Node{NodeID: RandomNodeID()}
+	var target [20]byte
+
+	seed := contactWithFirstByte(0x80)
+	near := contactWithFirstByte(0x10)
+	dead := contactWithFirstByte(0x20)
+	seeds := []Contact{seed}
+
+	tr := newLookupTrace(target, seeds)
+	res, err := n.runDisjointLookup(context.Background(), target, seeds, fixedTimeout(time.Second), func(ctx context.Context, c Contact) (queryResult, error) {
+		switch c.ID {
+		case seed.ID:
+			return queryResult{contacts: []Contact{near, dead}}, nil
+		case dead.ID:
+			return queryResult{}, errors.New("boom")
+		}
+		return queryResult{}, nil
+	}, tr)
+	tr.finish(res, err)
+
+	if len(tr.Hops) != 3 {
+		t.Fatalf("expected 3 hops, got %d", len(tr.Hops))
+	}
+	byPeer := map[string]TraceHop{}
+	for _, h := range tr.Hops {
+		byPeer[h.Peer.ID] = h
+	}
+	id := func(c Contact) string { return hex.EncodeToString(c.ID[:]) }
+
+	h := byPeer[id(seed)]
+	if h.Via != "" || h.NumReturned != 2 || h.Added != 2 || !h.Improved {
+		t.Fatalf("bad seed hop: %+v", h)
+	}
+	if h := byPeer[id(near)]; h.Via != id(seed) {
+		t.Fatalf("near should be listed under the seed, got via=%q", h.Via)
+	}
+	if h := byPeer[id(dead)]; h.Error == "" || !h.Dropped {
+		t.Fatalf("failed hop not recorded as dropped: %+v", h)
+	}
+
+	var sb strings.Builder
+	tr.PrintTree(&sb)
+	if !strings.Contains(sb.String(), "\n    [p0] "+id(near)[:8]) {
+		t.Fatalf("near not nested under seed:\n%s", sb.String())
+	}
+}
+
+func TestTrace_MarshalFitsMax(t *testing.T) {
+	var key [20]byte
+	tr := newLookupTrace(key, nil)
+	pt := tr.path(0)
+	var returned []Contact
+	for i := 0; i < K; i++ {
+		returned = append(returned, contactWithFirstByte(byte(i)))
+	}
+	for i := 0; i < 40; i++ {
+		pt.hop(TraceHop{Peer: traceContact(contactWithFirstByte(byte(i)))}, time.Now(), returned)
+	}
+	tr.finish(lookupResult{}, nil)
+
+	raw, err := tr.Marshal(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) > 2000 {
+		t.Fatalf("trace is %d bytes, max was 2000", len(raw))
+	}
+	var back LookupTrace
+	if err := json.Unmarshal(raw, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Truncated == 0 || len(back.Hops)+back.Truncated != 40 {
+		t.Fatalf("expected hops to be truncated, got %d hops, %d truncated", len(back.Hops), back.Truncated)
+	}
+	if len(tr.Hops) != 40 || len(tr.Hops[0].Returned) != K {
+		t.Fatal("Marshal changed the trace itself")
+	}
+}
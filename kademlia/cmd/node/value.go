@@ -7,8 +7,10 @@ import (
 type Value struct {
 	Data        []byte
 	Origin      bool
+	Cached      bool // copy left by someone's lookup (CACHE rpc), not a real replica
 	LastPublish time.Time
 	ExpiresAt   time.Time
+	TTL         time.Duration // lifetime the publisher asked for (capped), what REFRESH extends it by
 }
 
 func NewValue(data []byte, ttl time.Duration) Value {
@@ -9,11 +9,16 @@ import (
 
 type Handler func(from *net.UDPAddr, env wire.Envelope)
 
+// size of the read buffer and of every datagram we send, bigger envelopes go out as fragments
+// (see wire.Envelope.Fragments)
+const MaxDatagram = 2048
+
 type UDPServer struct {
 	pc            net.PacketConn
 	addressString string
 	handler       Handler
 	down          chan struct{}
+	frags         *wire.Reassembler
 }
 
 // Creates a new UDP transport server
@@ -27,6 +32,7 @@ func NewUDP(bind string, h Handler) (*UDPServer, error) {
 		addressString: pc.LocalAddr().String(),
 		handler:       h,
 		down:          make(chan struct{}),
+		frags:         wire.NewReassembler(wire.DefaultFragmentTimeout, wire.DefaultFragmentMemory),
 	}, nil
 }
 
@@ -37,7 +43,7 @@ func (server *UDPServer) Addr() string { return server.addressString }
 // Starts listening for incoming packets
 func (server *UDPServer) Start() {
 	go func() {
-		buf := make([]byte, 2048)
+		buf := make([]byte, MaxDatagram)
 		for {
 			_ = server.pc.SetReadDeadline(time.Now().Add(750 * time.Millisecond))
 			n, from, err := server.pc.ReadFrom(buf)
@@ -52,9 +58,15 @@ func (server *UDPServer) Start() {
 			if err != nil {
 				return
 			}
-			//env, err := wire.Unmarshal(buf[:n])
-
-			env, err := wire.Unmarshal(buf[:n])
+			// copy the datagram, buf is reused for the next read while the envelope may still be
+			// sitting in a waiter channel, or its fragment in the reassembler
+			env, err := wire.Unmarshal(append([]byte(nil), buf[:n]...))
+			if err == nil && env.Type == wire.FragmentType {
+				var complete bool
+				if env, complete = server.frags.Add(from.String(), env); !complete {
+					continue
+				}
+			}
 			if err == nil && server.handler != nil {
 				server.handler(from.(*net.UDPAddr), env)
 			}
@@ -68,9 +80,9 @@ func (server *UDPServer) Send(target string, env wire.Envelope) error {
 	if err != nil {
 		return err
 	}
-	defer conn.Close()                 // always defer before action to ensure we release socket (straight from tutorial)
-	_, err = conn.Write(env.Marshal()) // send msg
-	return err
+	defer conn.Close() // always defer before action to ensure we release socket (straight from tutorial)
+	// send msg
+	return writeFragments(env, func(b []byte) error { _, err := conn.Write(b); return err })
 }
 
 // send from listener used for replies
@@ -79,14 +91,30 @@ func (server *UDPServer) SendFromListener(to string, env wire.Envelope) error {
 	if err != nil {
 		return err
 	}
-	_, err = server.pc.WriteTo(env.Marshal(), raddr)
-	return err
+	return server.writeTo(env, raddr)
 }
 
 // reply from listener used for replies
 func (server *UDPServer) Reply(target *net.UDPAddr, env wire.Envelope) error {
-	_, err := server.pc.WriteTo(env.Marshal(), target) // change payload to envelope once struct and functinos are implemented
-	return err
+	return server.writeTo(env, target)
+}
+
+func (server *UDPServer) writeTo(env wire.Envelope, to net.Addr) error {
+	return writeFragments(env, func(b []byte) error { _, err := server.pc.WriteTo(b, to); return err })
+}
+
+// writes env as one datagram, or as many fragments as it takes to stay within MaxDatagram
+func writeFragments(env wire.Envelope, write func([]byte) error) error {
+	frags, err := env.Fragments(MaxDatagram)
+	if err != nil {
+		return err
+	}
+	for _, f := range frags {
+		if err := write(f); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Stops the server and closes the underlying socket
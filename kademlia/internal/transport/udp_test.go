@@ -2,6 +2,7 @@
 package transport
 
 import (
+	"bytes"
 	"net"
 	"testing"
 	"time"
@@ -157,3 +158,38 @@ func TestUDP_SendFromListener_InvalidAddr(t *testing.T) {
 		t.Fatal("expected error for invalid address, got nil")
 	}
 }
+
+func TestUDP_LargeEnvelopeIsFragmented(t *testing.T) {
+	got := make(chan wire.Envelope, 1)
+	srvB, err := NewUDP("127.0.0.1:0", func(from *net.UDPAddr, env wire.Envelope) { got <- env })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvB.Close()
+	srvB.Start()
+
+	srvA, err := NewUDP("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvA.Close()
+	srvA.Start()
+
+	payload := make([]byte, 20*MaxDatagram)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	env := wire.Envelope{ID: wire.NewRPCID(), Type: "big", Payload: payload}
+	if err := srvA.SendFromListener(srvB.Addr(), env); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-got:
+		if e.Type != "big" || e.ID != env.ID || !bytes.Equal(e.Payload, payload) {
+			t.Fatalf("bad envelope: %s %d bytes", e.Type, len(e.Payload))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
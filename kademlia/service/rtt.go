@@ -0,0 +1,95 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// defaults for the per-peer retransmission timeout (RTO), see Service.RTO
+const (
+	DefaultMinRTO     = 200 * time.Millisecond
+	DefaultMaxRTO     = 5 * time.Second
+	DefaultInitialRTO = time.Second // used for peers we have no round trip sample of yet
+)
+
+// smoothed round trip time of one peer address, kept the way TCP does it (RFC 6298)
+type rttEstimate struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration // srtt + 4*rttvar, doubled on every timeout until the next sample
+}
+
+// round trip estimates for every peer address we talked to
+type rttTable struct {
+	mu    sync.Mutex
+	peers map[string]*rttEstimate
+}
+
+func newRTTTable() *rttTable {
+	return &rttTable{peers: make(map[string]*rttEstimate)}
+}
+
+// feeds one measured round trip to addr into its estimate
+func (t *rttTable) observe(addr string, rtt time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.peers[addr]
+	if !ok {
+		// first sample: srtt = r, rttvar = r/2
+		e = &rttEstimate{srtt: rtt, rttvar: rtt / 2}
+		t.peers[addr] = e
+	} else {
+		// rttvar = 3/4 rttvar + 1/4 |srtt - r|, srtt = 7/8 srtt + 1/8 r
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.rto = e.srtt + 4*e.rttvar
+}
+
+// an rpc to addr timed out, back off its rto (the peer might just be slower than we thought)
+func (t *rttTable) backoff(addr string, max time.Duration) {
+	if max <= 0 {
+		max = time.Minute
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.peers[addr]; ok && e.rto < max {
+		e.rto *= 2
+	}
+}
+
+func (t *rttTable) get(addr string) (rttEstimate, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.peers[addr]
+	if !ok {
+		return rttEstimate{}, false
+	}
+	return *e, true
+}
+
+// RTO is the timeout to use for one rpc to addr: srtt + 4*rttvar of the answers we got from it so far,
+// kept between MinRTO and MaxRTO. addresses we never heard back from get InitialRTO
+func (s *Service) RTO(addr string) time.Duration {
+	rto := s.InitialRTO
+	if e, ok := s.rtt.get(addr); ok {
+		rto = e.rto
+	}
+	if rto < s.MinRTO {
+		rto = s.MinRTO
+	}
+	if s.MaxRTO > 0 && rto > s.MaxRTO {
+		rto = s.MaxRTO
+	}
+	return rto
+}
+
+// RTT returns the smoothed round trip time to addr and its variance, ok is false if we have no sample
+func (s *Service) RTT(addr string) (srtt, rttvar time.Duration, ok bool) {
+	e, ok := s.rtt.get(addr)
+	return e.srtt, e.rttvar, ok
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -15,16 +18,31 @@ import (
 	"github.com/Limpowitch/D7024E-Lab-Assignment/kademlia/wire"
 )
 
+// ErrTimeout is returned when the request's deadline passed without a reply, a cancelled request
+// returns ctx.Err() instead
 var ErrTimeout = errors.New("rpc timeout")
 
+// MaxValueSize is the biggest value STORE and CACHE can carry, their length field is 2 bytes.
+// values bigger than one datagram are fragmented by the transport
+const MaxValueSize = 0xFFFF
+
+var ErrValueTooLarge = fmt.Errorf("value too large (max %d bytes)", MaxValueSize)
+
+// the biggest trace we send back in ADMIN_TRACE_RESP
+const maxTracePayload = 64 << 10
+
 // callbacks for server
 type NodeID = [20]byte // local alias; avoids importing node
 type FindNodeHandler func(target NodeID) []byte
 type SeenHook func(addr string, peerID [20]byte) // added it just for qualifying later on
-type StoreHandler func(key [20]byte, val []byte)
-type FindValueHandler func(key [20]byte) (val []byte, contactsPayload []byte)
+// ttl 0 = the receiver's default, expiresIn 0 = the copy may live its whole ttl. a non-nil error
+// rejects the value
+type StoreHandler func(key [20]byte, val []byte, ttl, expiresIn time.Duration) error
+type CacheHandler func(key [20]byte, val []byte, ttl time.Duration) error
+type FindValueHandler func(key [20]byte) (val []byte, contactsPayload []byte) // val non-nil (maybe empty) if we hold it
 type DumpRTHandler func() []byte
 type ExitHandler func()
+type RPCDoneHook func(addr string, err error) // err is nil if the peer answered, not called for cancelled requests
 
 type Service struct {
 	udp *transport.UDPServer
@@ -37,14 +55,23 @@ type Service struct {
 	SelfAddr    string
 	OnFindNode  FindNodeHandler
 	OnStore     StoreHandler
+	OnCache     CacheHandler
 	OnFindValue FindValueHandler
 	OnDumpRT    DumpRTHandler
 	OnExit      ExitHandler
+	OnRPCDone   RPCDoneHook // called after outgoing requests that got an answer or failed, so the node can track failing peers
+
+	// bounds of the per-peer rpc timeout, see RTO
+	MinRTO     time.Duration
+	MaxRTO     time.Duration
+	InitialRTO time.Duration
+	rtt        *rttTable
 
-	OnAdminPut    func(value []byte) (key [20]byte, err error)
+	OnAdminPut    func(value []byte, ttl time.Duration) (key [20]byte, err error) // ttl 0 = the node's default
 	OnAdminGet    func(ctx context.Context, key [20]byte) (value []byte, ok bool)
 	OnAdminForget func(key [20]byte) bool
-	OnRefresh     func(key [20]byte)
+	OnAdminTrace  func(ctx context.Context, key [20]byte, max int) []byte // json trace of a lookup for key, at most max bytes
+	OnRefresh     func(key [20]byte) bool                                 // false if we do not hold key
 }
 
 // Creates a new Service listening on bind (UDP addr) and identifying as selfID
@@ -53,6 +80,11 @@ func New(bind string, selfID [20]byte, selfAddr string) (*Service, error) {
 		waiters:  make(map[wire.RPCID]chan wire.Envelope),
 		SelfID:   selfID,
 		SelfAddr: selfAddr,
+
+		MinRTO:     DefaultMinRTO,
+		MaxRTO:     DefaultMaxRTO,
+		InitialRTO: DefaultInitialRTO,
+		rtt:        newRTTTable(),
 	}
 	udp, err := transport.NewUDP(bind, s.onPacket)
 	if err != nil {
@@ -92,19 +124,45 @@ func (s *Service) AdminForget(ctx context.Context, to string, key [20]byte) erro
 	return nil
 }
 
-func (s *Service) Refresh(ctx context.Context, to string, key [20]byte) error {
+// REFRESH RPC resets the ttl of a value the peer holds. held reports whether it had the key at all,
+// if not the caller has to STORE it again
+func (s *Service) Refresh(ctx context.Context, to string, key [20]byte) (held bool, err error) {
 	req := wire.Envelope{ID: wire.NewRPCID(), Type: "REFRESH", Payload: key[:]}
 	resp, err := s.sendAndWait(ctx, to, req)
 	if err != nil {
-		return err
+		return false, err
 	}
 	if resp.Type != "REFRESH_ACK" {
-		return errors.New("bad REFRESH response: " + resp.Type)
+		return false, errors.New("bad REFRESH response: " + resp.Type)
 	}
-	return nil
+	// payload: held(1). peers that do not say are taken to have it, as REFRESH_ACK used to mean
+	return len(resp.Payload) == 0 || resp.Payload[0] != 0, nil
 }
 
 func (service *Service) sendAndWait(ctx context.Context, to string, env wire.Envelope) (wire.Envelope, error) {
+	sent := time.Now()
+	resp, err := service.roundTrip(ctx, to, env)
+	// admin requests wait for a whole lookup on the other side, they say nothing about the link
+	if !strings.HasPrefix(env.Type, "ADMIN_") {
+		switch {
+		case err == nil:
+			service.rtt.observe(to, time.Since(sent))
+		case errors.Is(err, ErrTimeout):
+			service.rtt.backoff(to, service.MaxRTO)
+		}
+	}
+	// the caller gave up on the request, that says nothing about the peer
+	if errors.Is(err, context.Canceled) {
+		return resp, err
+	}
+	if service.OnRPCDone != nil {
+		service.OnRPCDone(to, err)
+	}
+	return resp, err
+}
+
+// sends the request and blocks until the reply (or ctx) arrives
+func (service *Service) roundTrip(ctx context.Context, to string, env wire.Envelope) (wire.Envelope, error) {
 	// register waiter
 	ch := make(chan wire.Envelope, 1)
 	service.mu.Lock()
@@ -127,7 +185,10 @@ func (service *Service) sendAndWait(ctx context.Context, to string, env wire.Env
 		service.mu.Lock()
 		delete(service.waiters, env.ID)
 		service.mu.Unlock()
-		return wire.Envelope{}, ErrTimeout
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return wire.Envelope{}, ErrTimeout
+		}
+		return wire.Envelope{}, ctx.Err()
 	}
 }
 
@@ -160,25 +221,84 @@ func (s *Service) FindNode(ctx context.Context, to string, target NodeID) ([]byt
 	return resp.Payload, nil // raw bytes; node layer will decode
 }
 
-// STORE RPC that store a value and returns acks that it was stored
-func (service *Service) Store(ctx context.Context, to string, key [20]byte, value []byte) error {
-	// build payload: key(20) + len(2) + value
-	if len(value) > 65535 {
-		return errors.New("value too large (>65535)")
+// STORE RPC that store a value and returns acks that it was stored. ttl is how long the publisher
+// wants it kept, the receiver caps it at its own maximum. 0 leaves it to the receiver
+func (service *Service) Store(ctx context.Context, to string, key [20]byte, value []byte, ttl time.Duration) error {
+	return service.StoreReplica(ctx, to, key, value, ttl, 0)
+}
+
+// StoreReplica is Store for a copy that only has expiresIn left to live, as when a replica is passed
+// on by a node that holds it: the value keeps the publisher's ttl, but does not outlive the original
+func (service *Service) StoreReplica(ctx context.Context, to string, key [20]byte, value []byte, ttl, expiresIn time.Duration) error {
+	// build payload: key(20) + ttl ms(4) + expires in ms(4) + len(2) + value
+	if len(value) > MaxValueSize {
+		return ErrValueTooLarge
 	}
-	payload := make([]byte, 20+2+len(value))
+	payload := make([]byte, 20+4+4+2+len(value))
 	copy(payload[:20], key[:])
-	payload[20] = byte(len(value) >> 8)
-	payload[21] = byte(len(value))
-	copy(payload[22:], value)
+	binary.BigEndian.PutUint32(payload[20:24], ttlMillis(ttl))
+	binary.BigEndian.PutUint32(payload[24:28], ttlMillis(expiresIn))
+	binary.BigEndian.PutUint16(payload[28:30], uint16(len(value)))
+	copy(payload[30:], value)
 
 	req := wire.Envelope{ID: wire.NewRPCID(), Type: "STORE", Payload: payload}
-	_, err := service.sendAndWait(ctx, to, req)
-	return err
+	resp, err := service.sendAndWait(ctx, to, req)
+	if err != nil {
+		return err
+	}
+	switch resp.Type {
+	case "STORE_ACK":
+		return nil
+	case "STORE_REJECT":
+		return errors.New("store rejected: " + string(resp.Payload))
+	default:
+		return errors.New("bad STORE response: " + resp.Type)
+	}
+}
+
+// CACHE RPC stores a copy of a value found by a lookup at a node on the lookup path. unlike STORE
+// it carries a (short) ttl chosen by the caller, and the receiver knows the copy is only a cache
+func (service *Service) Cache(ctx context.Context, to string, key [20]byte, value []byte, ttl time.Duration) error {
+	// build payload: key(20) + ttl ms(4) + len(2) + value
+	if len(value) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+	payload := make([]byte, 20+4+2+len(value))
+	copy(payload[:20], key[:])
+	binary.BigEndian.PutUint32(payload[20:24], ttlMillis(ttl))
+	binary.BigEndian.PutUint16(payload[24:26], uint16(len(value)))
+	copy(payload[26:], value)
+
+	req := wire.Envelope{ID: wire.NewRPCID(), Type: "CACHE", Payload: payload}
+	resp, err := service.sendAndWait(ctx, to, req)
+	if err != nil {
+		return err
+	}
+	switch resp.Type {
+	case "CACHE_ACK":
+	case "CACHE_REJECT":
+		return errors.New("cache rejected: " + string(resp.Payload))
+	default:
+		return errors.New("bad CACHE response: " + resp.Type)
+	}
+	return nil
+}
+
+// a ttl as the 4 byte millisecond count STORE, CACHE and ADMIN_PUT carry, saturating at about 49 days
+func ttlMillis(ttl time.Duration) uint32 {
+	ms := ttl / time.Millisecond
+	if ms > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	if ms < 0 {
+		return 0
+	}
+	return uint32(ms)
 }
 
 type FindValueResult struct {
-	Value    []byte // if non-nil, we got the value
+	Found    bool   // the peer had the value, which may be empty
+	Value    []byte // the value if Found
 	Contacts []byte // encoded contacts payload; decode in node layer (UnmarshalContactList)
 }
 
@@ -204,7 +324,7 @@ func (service *Service) FindValue(ctx context.Context, to string, key [20]byte)
 	}
 	switch resp.Type {
 	case "FIND_VALUE_VAL":
-		return FindValueResult{Value: resp.Payload}, nil
+		return FindValueResult{Found: true, Value: append([]byte{}, resp.Payload...)}, nil
 	case "FIND_VALUE_CONT":
 		return FindValueResult{Contacts: resp.Payload}, nil
 	default:
@@ -263,22 +383,28 @@ func (service *Service) onPacket(from *net.UDPAddr, env wire.Envelope) {
 	case "STORE":
 		log.Printf("[service] STORE from %s id=%x", from.String(), env.ID[:4])
 
-		// 20 + 2, so if less, it must be a invalid/bad request
-		if len(env.Payload) < 22 {
+		// 20 + 4 + 4 + 2, so if less, it must be a invalid/bad request
+		if len(env.Payload) < 30 {
 			return
 		}
 
 		var key [20]byte
 		copy(key[:], env.Payload[:20])
-		l := int(env.Payload[20])<<8 | int(env.Payload[21])
-		if 22+l > len(env.Payload) {
+		ttl := time.Duration(binary.BigEndian.Uint32(env.Payload[20:24])) * time.Millisecond
+		expiresIn := time.Duration(binary.BigEndian.Uint32(env.Payload[24:28])) * time.Millisecond
+		l := int(binary.BigEndian.Uint16(env.Payload[28:30]))
+		if 30+l > len(env.Payload) {
 			return
 		}
 		val := make([]byte, l)
-		copy(val, env.Payload[22:22+l])
+		copy(val, env.Payload[30:30+l])
 
 		if service.OnStore != nil {
-			service.OnStore(key, val)
+			if err := service.OnStore(key, val, ttl, expiresIn); err != nil {
+				log.Printf("[service] STORE from %s rejected: %v", from.String(), err)
+				_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "STORE_REJECT", Payload: []byte(err.Error())})
+				return
+			}
 		}
 		_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "STORE_ACK"})
 
@@ -287,6 +413,35 @@ func (service *Service) onPacket(from *net.UDPAddr, env wire.Envelope) {
 		// exactly as pong. maybe create function which both can call upon?
 		service.wake(env.ID, env)
 
+	case "STORE_REJECT":
+		service.wake(env.ID, env)
+
+	case "CACHE":
+		// 20 + 4 + 2, so if less, it must be a invalid/bad request
+		if len(env.Payload) < 26 {
+			return
+		}
+		var key [20]byte
+		copy(key[:], env.Payload[:20])
+		ttl := time.Duration(binary.BigEndian.Uint32(env.Payload[20:24])) * time.Millisecond
+		l := int(binary.BigEndian.Uint16(env.Payload[24:26]))
+		if 26+l > len(env.Payload) {
+			return
+		}
+		val := make([]byte, l)
+		copy(val, env.Payload[26:26+l])
+
+		if service.OnCache != nil {
+			if err := service.OnCache(key, val, ttl); err != nil {
+				_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "CACHE_REJECT", Payload: []byte(err.Error())})
+				return
+			}
+		}
+		_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "CACHE_ACK"})
+
+	case "CACHE_ACK", "CACHE_REJECT":
+		service.wake(env.ID, env)
+
 	case "FIND_VALUE":
 		log.Printf("[service] FIND_VALUE from %s id=%x", from.String(), env.ID[:4])
 
@@ -340,7 +495,7 @@ func (service *Service) onPacket(from *net.UDPAddr, env wire.Envelope) {
 	case "ADMIN_GET":
 		go service.handleAdminGet(from, env)
 
-	case "ADMIN_PUT_RESP":
+	case "ADMIN_PUT_RESP", "ADMIN_PUT_REJECT":
 		service.wake(env.ID, env)
 
 	case "ADMIN_GET_VAL":
@@ -349,6 +504,12 @@ func (service *Service) onPacket(from *net.UDPAddr, env wire.Envelope) {
 	case "ADMIN_GET_NOTFOUND":
 		service.wake(env.ID, env)
 
+	case "ADMIN_TRACE":
+		go service.handleAdminTrace(from, env)
+
+	case "ADMIN_TRACE_RESP":
+		service.wake(env.ID, env)
+
 	case "ADMIN_EXIT":
 		// reply first so the client doesnt hang, then terminate async.
 		_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "ADMIN_EXIT_OK"})
@@ -387,9 +548,16 @@ func (service *Service) onPacket(from *net.UDPAddr, env wire.Envelope) {
 		if len(env.Payload) >= 20 {
 			copy(key[:], env.Payload[:20])
 		}
-		// reset TTL if we have it
-		service.OnRefresh(key) // callback set by node
-		_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "REFRESH_ACK"})
+		// reset TTL if we have it, and tell whether we do
+		held := false
+		if service.OnRefresh != nil {
+			held = service.OnRefresh(key) // callback set by node
+		}
+		var pl byte
+		if held {
+			pl = 1
+		}
+		_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "REFRESH_ACK", Payload: []byte{pl}})
 	case "REFRESH_ACK":
 		service.wake(env.ID, env)
 
@@ -397,15 +565,24 @@ func (service *Service) onPacket(from *net.UDPAddr, env wire.Envelope) {
 	}
 }
 
-// AdminPut asks a running node (daemon) to store a value using its RT.
-// Request:  value bytes
-// Response: 20B key (SHA-1)
-func (s *Service) AdminPut(ctx context.Context, to string, value []byte) ([20]byte, error) {
-	req := wire.Envelope{ID: wire.NewRPCID(), Type: "ADMIN_PUT", Payload: value}
+// AdminPut asks a running node (daemon) to store a value using its RT, for ttl (0 = the node's
+// default).
+// Request:  ttl ms(4) + value bytes
+// Response: 20B key (SHA-1), or ADMIN_PUT_REJECT with the reason as text
+func (s *Service) AdminPut(ctx context.Context, to string, value []byte, ttl time.Duration) ([20]byte, error) {
+	if len(value) > MaxValueSize {
+		return [20]byte{}, ErrValueTooLarge
+	}
+	payload := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(value)), ttlMillis(ttl))
+	payload = append(payload, value...)
+	req := wire.Envelope{ID: wire.NewRPCID(), Type: "ADMIN_PUT", Payload: payload}
 	resp, err := s.sendAndWait(ctx, to, req)
 	if err != nil {
 		return [20]byte{}, err
 	}
+	if resp.Type == "ADMIN_PUT_REJECT" {
+		return [20]byte{}, errors.New("put rejected: " + string(resp.Payload))
+	}
 	if resp.Type != "ADMIN_PUT_RESP" || len(resp.Payload) != 20 {
 		return [20]byte{}, errors.New("bad ADMIN_PUT response")
 	}
@@ -414,15 +591,15 @@ func (s *Service) AdminPut(ctx context.Context, to string, value []byte) ([20]by
 	return key, nil
 }
 
-// AdminGet asks a running node (daemon) to resolve a key using its RT.
-// Response: value (if found) or notfound.
-func (s *Service) AdminGet(ctx context.Context, to string, key [20]byte) ([]byte, bool, error) {
+// builds the key(20) + timeout ms(4) payload of ADMIN_GET and ADMIN_TRACE, the timeout is the
+// budget left in ctx so the daemon gives up before we do
+func adminKeyPayload(ctx context.Context, key [20]byte) ([]byte, error) {
 	// derive remaining budget from ctx
 	timeoutMs := uint32(10000)
 	if dl, ok := ctx.Deadline(); ok {
 		left := time.Until(dl)
 		if left <= 0 {
-			return nil, false, ctx.Err()
+			return nil, ctx.Err()
 		}
 		if left > 60*time.Second {
 			left = 60 * time.Second
@@ -433,6 +610,16 @@ func (s *Service) AdminGet(ctx context.Context, to string, key [20]byte) ([]byte
 	payload := make([]byte, 24)
 	copy(payload[:20], key[:])
 	binary.BigEndian.PutUint32(payload[20:], timeoutMs)
+	return payload, nil
+}
+
+// AdminGet asks a running node (daemon) to resolve a key using its RT.
+// Response: value (if found) or notfound.
+func (s *Service) AdminGet(ctx context.Context, to string, key [20]byte) ([]byte, bool, error) {
+	payload, err := adminKeyPayload(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
 
 	req := wire.Envelope{ID: wire.NewRPCID(), Type: "ADMIN_GET", Payload: payload}
 	resp, err := s.sendAndWait(ctx, to, req)
@@ -452,6 +639,23 @@ func (s *Service) AdminGet(ctx context.Context, to string, key [20]byte) ([]byte
 	}
 }
 
+// AdminTrace asks a running node (daemon) to run a traced lookup for key and returns the trace as json
+func (s *Service) AdminTrace(ctx context.Context, to string, key [20]byte) ([]byte, error) {
+	payload, err := adminKeyPayload(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	req := wire.Envelope{ID: wire.NewRPCID(), Type: "ADMIN_TRACE", Payload: payload}
+	resp, err := s.sendAndWait(ctx, to, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type != "ADMIN_TRACE_RESP" || len(resp.Payload) == 0 {
+		return nil, errors.New("bad ADMIN_TRACE response")
+	}
+	return resp.Payload, nil
+}
+
 // Helper to wake up a waiter for a given RPC ID
 func (s *Service) wake(id wire.RPCID, env wire.Envelope) {
 	s.mu.Lock()
@@ -465,16 +669,25 @@ func (s *Service) wake(id wire.RPCID, env wire.Envelope) {
 // Handles an incoming ADMIN_PUT request
 func (service *Service) handleAdminPut(from *net.UDPAddr, env wire.Envelope) {
 	log.Printf("[service] ADMIN_PUT from %s", from.String())
+	reject := func(reason string) {
+		_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "ADMIN_PUT_REJECT", Payload: []byte(reason)})
+	}
 	if service.OnAdminPut == nil {
-		_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "ADMIN_PUT_RESP"})
+		reject("node does not take puts")
 		return
 	}
 
-	val := append([]byte(nil), env.Payload...)
+	if len(env.Payload) < 4 {
+		reject("bad ADMIN_PUT request")
+		return
+	}
+	ttl := time.Duration(binary.BigEndian.Uint32(env.Payload[:4])) * time.Millisecond
+	val := append([]byte(nil), env.Payload[4:]...)
 
-	key, err := service.OnAdminPut(val)
+	key, err := service.OnAdminPut(val, ttl)
 	if err != nil {
-		_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "ADMIN_PUT_RESP"})
+		log.Printf("[service] ADMIN_PUT from %s rejected: %v", from.String(), err)
+		reject(err.Error())
 		return
 	}
 	_ = service.udp.Reply(from, wire.Envelope{
@@ -484,6 +697,18 @@ func (service *Service) handleAdminPut(from *net.UDPAddr, env wire.Envelope) {
 	})
 }
 
+// reads the timeout the client sent along with the key (or the default) and returns a ctx for it
+func adminKeyContext(payload []byte) (context.Context, context.CancelFunc) {
+	timeoutMs := uint32(10000)
+	if len(payload) >= 24 {
+		timeoutMs = binary.BigEndian.Uint32(payload[20:])
+		if timeoutMs == 0 {
+			timeoutMs = 1
+		}
+	}
+	return context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+}
+
 func (service *Service) handleAdminGet(from *net.UDPAddr, env wire.Envelope) {
 	log.Printf("[service] ADMIN_GET from %s", from.String())
 	if len(env.Payload) < 20 {
@@ -495,14 +720,7 @@ func (service *Service) handleAdminGet(from *net.UDPAddr, env wire.Envelope) {
 	copy(key[:], env.Payload[:20])
 
 	// derive timeout from client payload (or default)
-	timeoutMs := uint32(10000)
-	if len(env.Payload) >= 24 {
-		timeoutMs = binary.BigEndian.Uint32(env.Payload[20:])
-		if timeoutMs == 0 {
-			timeoutMs = 1
-		}
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	ctx, cancel := adminKeyContext(env.Payload)
 	defer cancel()
 
 	if service.OnAdminGet == nil {
@@ -512,10 +730,32 @@ func (service *Service) handleAdminGet(from *net.UDPAddr, env wire.Envelope) {
 
 	val, ok := service.OnAdminGet(ctx, key)
 	if ok {
-		log.Printf("[admin-get] FOUND -> replying ADMIN_GET_VAL with value=%q len=%d", string(val), len(val))
+		log.Printf("[admin-get] FOUND -> replying ADMIN_GET_VAL len=%d", len(val))
 		_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "ADMIN_GET_VAL", Payload: val})
 		return
 	}
 	log.Printf("[admin-get] NOTFOUND -> replying ADMIN_GET_NOTFOUND")
 	_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "ADMIN_GET_NOTFOUND"})
 }
+
+func (service *Service) handleAdminTrace(from *net.UDPAddr, env wire.Envelope) {
+	log.Printf("[service] ADMIN_TRACE from %s", from.String())
+	if len(env.Payload) < 20 || service.OnAdminTrace == nil {
+		_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "ADMIN_TRACE_RESP"})
+		return
+	}
+
+	var key [20]byte
+	copy(key[:], env.Payload[:20])
+
+	// the lookup must end a little before the client gives up, or the reply comes too late
+	ctx, cancel := adminKeyContext(env.Payload)
+	defer cancel()
+	if dl, ok := ctx.Deadline(); ok && time.Until(dl) > 500*time.Millisecond {
+		var c2 context.CancelFunc
+		ctx, c2 = context.WithDeadline(ctx, dl.Add(-250*time.Millisecond))
+		defer c2()
+	}
+
+	_ = service.udp.Reply(from, wire.Envelope{ID: env.ID, Type: "ADMIN_TRACE_RESP", Payload: service.OnAdminTrace(ctx, key, maxTracePayload)})
+}
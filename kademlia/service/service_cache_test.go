@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCache_RoundTrip(t *testing.T) {
+	var idA, idB [20]byte
+	a, _ := New("127.0.0.1:0", idA, "")
+	defer a.Close()
+	a.Start()
+	b, _ := New("127.0.0.1:0", idB, "")
+	defer b.Close()
+
+	type cached struct {
+		key [20]byte
+		val []byte
+		ttl time.Duration
+	}
+	got := make(chan cached, 1)
+	b.OnCache = func(k [20]byte, v []byte, ttl time.Duration) error {
+		got <- cached{k, append([]byte(nil), v...), ttl}
+		return nil
+	}
+	b.Start() // handlers are set before the server starts reading
+
+	key := [20]byte{4, 5, 6}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.Cache(ctx, b.Addr(), key, []byte("hello"), 1500*time.Millisecond); err != nil {
+		t.Fatalf("Cache: %v", err)
+	}
+	c := <-got
+	if c.key != key || string(c.val) != "hello" || c.ttl != 1500*time.Millisecond {
+		t.Fatalf("bad cache: %x %q %v", c.key, c.val, c.ttl)
+	}
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRTTTable_SmoothsLikeTCP(t *testing.T) {
+	tb := newRTTTable()
+	tb.observe("p", 100*time.Millisecond)
+	e, _ := tb.get("p")
+	if e.srtt != 100*time.Millisecond || e.rttvar != 50*time.Millisecond || e.rto != 300*time.Millisecond {
+		t.Fatalf("first sample: %+v", e)
+	}
+
+	tb.observe("p", 20*time.Millisecond)
+	e, _ = tb.get("p")
+	// rttvar = (3*50 + 80)/4 = 57.5, srtt = (7*100 + 20)/8 = 90
+	if e.srtt != 90*time.Millisecond || e.rttvar != 57500*time.Microsecond {
+		t.Fatalf("second sample: %+v", e)
+	}
+
+	tb.backoff("p", time.Minute)
+	if b, _ := tb.get("p"); b.rto != 2*e.rto {
+		t.Fatalf("timeout should double the rto: %v -> %v", e.rto, b.rto)
+	}
+}
+
+func TestRTO_ClampedAndLearnedFromPings(t *testing.T) {
+	var idA, idB [20]byte
+	a, _ := New("127.0.0.1:0", idA, "")
+	defer a.Close()
+	a.Start()
+	b, _ := New("127.0.0.1:0", idB, "")
+	defer b.Close()
+	b.Start()
+
+	if got := a.RTO(b.Addr()); got != a.InitialRTO {
+		t.Fatalf("unknown peer should get the initial rto, got %v", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := a.Ping(ctx, b.Addr()); err != nil {
+			t.Fatalf("ping failed: %v", err)
+		}
+		cancel()
+	}
+	if _, _, ok := a.RTT(b.Addr()); !ok {
+		t.Fatal("no rtt sample after pings")
+	}
+	// loopback round trips are far below the floor
+	if got := a.RTO(b.Addr()); got != a.MinRTO {
+		t.Fatalf("expected rto at the floor %v, got %v", a.MinRTO, got)
+	}
+
+	// nobody answers here: every timeout doubles the rto, but never past the ceiling
+	a.MaxRTO = 400 * time.Millisecond
+	a.rtt.observe("127.0.0.1:1", 150*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_ = a.Ping(ctx, "127.0.0.1:1")
+		cancel()
+	}
+	if got := a.RTO("127.0.0.1:1"); got != a.MaxRTO {
+		t.Fatalf("expected rto at the ceiling %v, got %v", a.MaxRTO, got)
+	}
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -13,21 +14,52 @@ func TestStore_RoundTrip(t *testing.T) {
 	a.Start()
 	b, _ := New("127.0.0.1:0", idB, "")
 	defer b.Close()
-	b.Start()
 
 	var gotKey [20]byte
 	var gotVal []byte
+	var gotTTL time.Duration
 	done := make(chan struct{}, 1)
-	b.OnStore = func(k [20]byte, v []byte) { gotKey = k; gotVal = append([]byte(nil), v...); done <- struct{}{} }
+	b.OnStore = func(k [20]byte, v []byte, ttl, _ time.Duration) error {
+		gotKey = k
+		gotVal = append([]byte(nil), v...)
+		gotTTL = ttl
+		done <- struct{}{}
+		return nil
+	}
+	b.Start() // handlers are set before the server starts reading
 
 	key := [20]byte{1, 2, 3}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	if err := a.Store(ctx, b.Addr(), key, []byte("hello")); err != nil {
+	if err := a.Store(ctx, b.Addr(), key, []byte("hello"), 10*time.Minute); err != nil {
 		t.Fatalf("Store: %v", err)
 	}
 	<-done
-	if gotKey != key || string(gotVal) != "hello" {
-		t.Fatalf("bad store: %x %q", gotKey, gotVal)
+	if gotKey != key || string(gotVal) != "hello" || gotTTL != 10*time.Minute {
+		t.Fatalf("bad store: %x %q %v", gotKey, gotVal, gotTTL)
+	}
+}
+
+func TestStore_LargestValueFitsAndBiggerIsRejected(t *testing.T) {
+	var idA, idB [20]byte
+	a, _ := New("127.0.0.1:0", idA, "")
+	defer a.Close()
+	a.Start()
+	b, _ := New("127.0.0.1:0", idB, "")
+	defer b.Close()
+	got := make(chan int, 1)
+	b.OnStore = func(k [20]byte, v []byte, ttl, _ time.Duration) error { got <- len(v); return nil }
+	b.Start() // handlers are set before the server starts reading
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.Store(ctx, b.Addr(), [20]byte{1}, make([]byte, MaxValueSize), 0); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if n := <-got; n != MaxValueSize {
+		t.Fatalf("value was cut to %d bytes", n)
+	}
+	if err := a.Store(ctx, b.Addr(), [20]byte{1}, make([]byte, MaxValueSize+1), 0); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
 	}
 }
@@ -2,6 +2,8 @@ package service
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 )
@@ -34,3 +36,74 @@ func TestPingPong(t *testing.T) {
 	}
 
 }
+
+func TestOnRPCDone_ReportsTimeoutAndSuccess(t *testing.T) {
+	var idA, idB [20]byte
+	a, _ := New("127.0.0.1:0", idA, "")
+	defer a.Close()
+	a.Start()
+	b, _ := New("127.0.0.1:0", idB, "")
+	defer b.Close()
+	b.Start()
+
+	type result struct {
+		addr string
+		err  error
+	}
+	got := make(chan result, 2)
+	a.OnRPCDone = func(addr string, err error) { got <- result{addr, err} }
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.Ping(ctx, b.Addr()); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	if r := <-got; r.addr != b.Addr() || r.err != nil {
+		t.Fatalf("expected success for %s, got %+v", b.Addr(), r)
+	}
+
+	// nobody answers on a closed socket
+	dead, _ := New("127.0.0.1:0", idB, "")
+	deadAddr := dead.Addr()
+	dead.Close()
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	if err := a.Ping(ctx2, deadAddr); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if r := <-got; r.addr != deadAddr || r.err != ErrTimeout {
+		t.Fatalf("expected timeout for %s, got %+v", deadAddr, r)
+	}
+	// a request the caller cancels is not the peer's fault and is not reported
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel3)
+	if err := a.Ping(ctx3, deadAddr); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	select {
+	case r := <-got:
+		t.Fatalf("cancelled request should not be reported, got %+v", r)
+	default:
+	}
+}
+
+func TestAdminPut_RejectionCarriesReason(t *testing.T) {
+	var idA, idB [20]byte
+	a, _ := New("127.0.0.1:0", idA, "")
+	defer a.Close()
+	a.Start()
+	b, _ := New("127.0.0.1:0", idB, "")
+	defer b.Close()
+	b.OnAdminPut = func(value []byte, ttl time.Duration) ([20]byte, error) {
+		return [20]byte{}, errors.New("store full")
+	}
+	b.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := a.AdminPut(ctx, b.Addr(), []byte("v"), 0)
+	if err == nil || !strings.Contains(err.Error(), "store full") {
+		t.Fatalf("expected the rejection to carry the reason, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package wire
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// envelopes that do not fit in one datagram are sent as numbered fragments. a fragment is itself an
+// envelope with the same rpc id and type FRAG, its payload is
+//
+// [2B index][2B count][slice of the marshalled envelope]
+//
+// the receiver collects them in a Reassembler and hands on the original envelope once all are in.
+
+const FragmentType = "FRAG"
+
+const (
+	fragHeader   = 2 + 2
+	MaxFragments = 1024 // per message, caps a message at about 2MB with 2KB datagrams
+)
+
+var ErrTooManyFragments = errors.New("message needs too many fragments")
+
+// Fragments marshals e into datagrams of at most max bytes: just e.Marshal() if that fits, FRAG
+// envelopes otherwise
+func (e Envelope) Fragments(max int) ([][]byte, error) {
+	raw := e.Marshal()
+	if len(raw) <= max {
+		return [][]byte{raw}, nil
+	}
+	per := max - (SizeOfID + 1 + len(FragmentType) + fragHeader)
+	if per <= 0 {
+		return nil, errors.New("datagram too small for a fragment")
+	}
+	count := (len(raw) + per - 1) / per
+	if count > MaxFragments {
+		return nil, ErrTooManyFragments
+	}
+
+	out := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		part := raw[i*per : min((i+1)*per, len(raw))]
+		pl := make([]byte, fragHeader, fragHeader+len(part))
+		binary.BigEndian.PutUint16(pl[0:2], uint16(i))
+		binary.BigEndian.PutUint16(pl[2:4], uint16(count))
+		pl = append(pl, part...)
+		out = append(out, Envelope{ID: e.ID, Type: FragmentType, Payload: pl}.Marshal())
+	}
+	return out, nil
+}
+
+// defaults for NewReassembler
+const (
+	DefaultFragmentTimeout = 5 * time.Second
+	DefaultFragmentMemory  = 8 << 20
+)
+
+// Reassembler puts fragmented envelopes back together. incomplete messages are dropped after
+// Timeout, and once they hold more than MaxBytes together the oldest ones are dropped first
+type Reassembler struct {
+	Timeout  time.Duration
+	MaxBytes int
+
+	mu      sync.Mutex
+	pending map[fragKey]*list.Element // of *partial
+	arrival *list.List                // the partials by first fragment, oldest at the front
+	held    int                       // bytes in pending, the parts slices included
+}
+
+// fragments of different senders may share an rpc id (replies carry the id of our request)
+type fragKey struct {
+	from string
+	id   RPCID
+}
+
+type partial struct {
+	key   fragKey
+	parts [][]byte
+	got   int
+	size  int // bytes of data in parts
+	mem   int // what it counts for in held: size plus the parts slice itself
+	first time.Time
+}
+
+// a sender that only ever sends the first fragment of MaxFragments-part messages still costs us the
+// parts slice of each, so that counts against MaxBytes too: a pointer, a length and a capacity per part
+const sliceHeader = 3 * 8
+
+func NewReassembler(timeout time.Duration, maxBytes int) *Reassembler {
+	return &Reassembler{Timeout: timeout, MaxBytes: maxBytes, pending: make(map[fragKey]*list.Element), arrival: list.New()}
+}
+
+// Add takes one FRAG envelope from sender from. once the last missing fragment of a message arrives
+// it returns the reassembled envelope and true
+func (r *Reassembler) Add(from string, frag Envelope) (Envelope, bool) {
+	if len(frag.Payload) < fragHeader {
+		return Envelope{}, false
+	}
+	idx := int(binary.BigEndian.Uint16(frag.Payload[0:2]))
+	count := int(binary.BigEndian.Uint16(frag.Payload[2:4]))
+	if count == 0 || count > MaxFragments || idx >= count {
+		return Envelope{}, false
+	}
+	data := frag.Payload[fragHeader:]
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.expire(now)
+
+	k := fragKey{from: from, id: frag.ID}
+	var p *partial
+	if el, ok := r.pending[k]; ok {
+		p = el.Value.(*partial)
+	} else {
+		p = &partial{key: k, parts: make([][]byte, count), mem: count * sliceHeader, first: now}
+		r.pending[k] = r.arrival.PushBack(p)
+		r.held += p.mem
+	}
+	if len(p.parts) != count || p.parts[idx] != nil {
+		return Envelope{}, false // duplicate, or a fragment that does not belong to this message
+	}
+	p.parts[idx] = data
+	p.got++
+	p.size += len(data)
+	p.mem += len(data)
+	r.held += len(data)
+
+	if p.got == count {
+		r.drop(k)
+		raw := make([]byte, 0, p.size)
+		for _, part := range p.parts {
+			raw = append(raw, part...)
+		}
+		env, err := Unmarshal(raw)
+		return env, err == nil
+	}
+
+	// over the memory cap: drop the oldest incomplete messages, this one included if need be
+	for r.held > r.MaxBytes && r.arrival.Len() > 0 {
+		r.drop(r.arrival.Front().Value.(*partial).key)
+	}
+	return Envelope{}, false
+}
+
+// drops messages that have been incomplete for longer than Timeout, they are all at the front
+func (r *Reassembler) expire(now time.Time) {
+	for el := r.arrival.Front(); el != nil; el = r.arrival.Front() {
+		p := el.Value.(*partial)
+		if now.Sub(p.first) <= r.Timeout {
+			return
+		}
+		r.drop(p.key)
+	}
+}
+
+func (r *Reassembler) drop(k fragKey) {
+	if el, ok := r.pending[k]; ok {
+		r.held -= el.Value.(*partial).mem
+		r.arrival.Remove(el)
+		delete(r.pending, k)
+	}
+}
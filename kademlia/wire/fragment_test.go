@@ -0,0 +1,86 @@
+package wire
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFragments_SmallEnvelopeIsUntouched(t *testing.T) {
+	env := Envelope{ID: NewRPCID(), Type: "PING", Payload: []byte("hi")}
+	frags, err := env.Fragments(2048)
+	if err != nil || len(frags) != 1 || !bytes.Equal(frags[0], env.Marshal()) {
+		t.Fatalf("expected the plain envelope, got %d fragments, err=%v", len(frags), err)
+	}
+}
+
+func TestFragments_ReassembleOutOfOrder(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+	env := Envelope{ID: NewRPCID(), Type: "FIND_VALUE_VAL", Payload: payload}
+	frags, err := env.Fragments(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frags) < 2 {
+		t.Fatalf("expected fragments, got %d", len(frags))
+	}
+
+	r := NewReassembler(time.Second, 1<<20)
+	for i := len(frags) - 1; i >= 0; i-- {
+		if len(frags[i]) > 512 {
+			t.Fatalf("fragment %d is %d bytes", i, len(frags[i]))
+		}
+		f, err := Unmarshal(frags[i])
+		if err != nil || f.Type != FragmentType || f.ID != env.ID {
+			t.Fatalf("bad fragment %d: %+v %v", i, f, err)
+		}
+		out, ok := r.Add("peer", f)
+		if ok != (i == 0) {
+			t.Fatalf("fragment %d: complete=%v", i, ok)
+		}
+		if ok && (out.Type != env.Type || out.ID != env.ID || !bytes.Equal(out.Payload, payload)) {
+			t.Fatalf("bad reassembly: %s %d bytes", out.Type, len(out.Payload))
+		}
+	}
+	if len(r.pending) != 0 || r.held != 0 {
+		t.Fatalf("reassembler still holds %d messages, %d bytes", len(r.pending), r.held)
+	}
+}
+
+func TestReassembler_DropsStaleAndCapsMemory(t *testing.T) {
+	frag := func(id RPCID) Envelope {
+		env := Envelope{ID: id, Type: "X", Payload: make([]byte, 3000)}
+		frags, _ := env.Fragments(1024)
+		f, _ := Unmarshal(frags[0])
+		return f
+	}
+
+	r := NewReassembler(20*time.Millisecond, 1<<20)
+	r.Add("peer", frag(NewRPCID()))
+	time.Sleep(30 * time.Millisecond)
+	r.Add("peer", frag(NewRPCID()))
+	if len(r.pending) != 1 {
+		t.Fatalf("stale message should be dropped, %d pending", len(r.pending))
+	}
+
+	r = NewReassembler(time.Minute, 2500)
+	first := NewRPCID()
+	r.Add("peer", frag(first))
+	r.Add("peer", frag(NewRPCID()))
+	r.Add("peer", frag(NewRPCID()))
+	if r.held > 2500 {
+		t.Fatalf("holding %d bytes, cap is 2500", r.held)
+	}
+	if _, ok := r.pending[fragKey{from: "peer", id: first}]; ok {
+		t.Fatal("the oldest message should be dropped first")
+	}
+	// a lone first fragment of a message with many parts costs the parts slice as well
+	r = NewReassembler(time.Minute, 1<<20)
+	big := Envelope{ID: NewRPCID(), Type: "X", Payload: make([]byte, 100*1024)}
+	frags, _ := big.Fragments(1024)
+	f, _ := Unmarshal(frags[0])
+	r.Add("peer", f)
+	if want := len(f.Payload) - fragHeader + len(frags)*sliceHeader; r.held != want {
+		t.Fatalf("holding %d bytes, want %d for the data and the parts slice", r.held, want)
+	}
+}